@@ -0,0 +1,313 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/mail"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/acme"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// accountKind is the Datastore kind of the ACME account entity.
+const accountKind = "AELetsEncryptAccount"
+
+// account is the Datastore entity of the ACME account.
+type account struct {
+	Key    []byte `datastore:",noindex"` // PKCS#1 DER encoded, unless in KMS
+	KMSKey string `datastore:",noindex"` // KMS key version holding the key
+	URI    string `datastore:",noindex"`
+}
+
+// accountEmail is the contact email of the ACME account, to which the CA
+// sends expiry warnings and important notices, read from the
+// AELE_ACCOUNT_EMAIL environment variable.
+var accountEmail = envEmail("AELE_ACCOUNT_EMAIL")
+
+// envEmail reads an email address from an environment variable, recording
+// invalid values in configErr.
+func envEmail(name string) string {
+	v := os.Getenv(name)
+	if v == "" {
+		return ""
+	}
+	if a, err := mail.ParseAddress(v); err != nil || a.Address != v {
+		if configErr == nil {
+			configErr = fmt.Errorf("invalid %v=%q: want an email address", name, v)
+		}
+		return ""
+	}
+	return v
+}
+
+// accountContact returns the contact URLs of the ACME account.
+func accountContact() []string {
+	if accountEmail == "" {
+		return nil
+	}
+	return []string{"mailto:" + accountEmail}
+}
+
+// equal returns whether two lists are equal.
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// accountMu prevents registering several accounts when domains are processed
+// in parallel on first use. It is only held to register and save an account,
+// not to look up an existing one, so that parallel orders do not wait for
+// each other.
+var accountMu sync.Mutex
+
+// accountClient returns an ACME client for the account of a CA saved in
+// Datastore. The saved account is looked up at the CA by its key with
+// onlyReturnExisting, so that no account is created by the lookup. On first
+// use, or if the saved account no longer exists or is deactivated at the CA,
+// it creates a key, registers a new account and saves it, so the account is
+// reused across runs instead of registering one every time.
+// It is therefore not deactivated after issuance: no abandoned accounts are
+// left behind to count towards the CA account rate limits.
+// With accountKMSKey, the account key is held in KMS, and a new account is
+// registered when it changes.
+func accountClient(ctx context.Context, ca ca) (*acme.Client, error) {
+	k := datastore.NewKey(ctx, accountKind, ca.directory, 0, nil)
+	a, err := loadAccount(ctx, k)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case a == nil:
+	case a.KMSKey != accountKMSKey:
+		log.Warningf(ctx, "account %v key changed, registering a new one", a.URI)
+	default:
+		client, err := existingAccount(ctx, ca, k, a)
+		if err != nil || client != nil {
+			return client, err
+		}
+		log.Warningf(ctx, "account %v no longer valid, registering a new one", a.URI)
+	}
+	return registerAccount(ctx, ca, k, a)
+}
+
+// loadAccount returns the saved account, or nil if there is none.
+func loadAccount(ctx context.Context, k *datastore.Key) (*account, error) {
+	var a account
+	switch err := datastore.Get(ctx, k, &a); err {
+	case nil:
+		return &a, nil
+	case datastore.ErrNoSuchEntity:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("datastore get: %v", err)
+	}
+}
+
+// existingAccount returns an ACME client for a saved account if it is still
+// valid at the CA, updating its saved URL and contact if they changed, or nil
+// if it no longer exists or is deactivated.
+func existingAccount(ctx context.Context, ca ca, k *datastore.Key, a *account) (*acme.Client, error) {
+	key, err := loadAccountKey(ctx, *a)
+	if err != nil {
+		return nil, fmt.Errorf("account key: %v", err)
+	}
+	client := newClient(ctx, ca.directory, key)
+	opCtx, cancel := operationContext(ctx)
+	acct, err := client.GetReg(opCtx, a.URI)
+	cancel()
+	if err != nil {
+		if accountGone(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get reg: %v", err)
+	}
+	if acct.Status != acme.StatusValid {
+		return nil, nil
+	}
+	if acct.URI != "" && acct.URI != a.URI {
+		// The CA returns the account URL of the key, which is authoritative.
+		a.URI = acct.URI
+		if _, err := datastore.Put(ctx, k, a); err != nil {
+			return nil, fmt.Errorf("datastore put: %v", err)
+		}
+	}
+	if contact := accountContact(); !equal(acct.Contact, contact) {
+		acct.Contact = contact
+		opCtx, cancel := operationContext(ctx)
+		_, err := client.UpdateReg(opCtx, acct)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("update reg: %v", err)
+		}
+	}
+	return client, nil
+}
+
+// registerAccount registers a new account replacing the saved one, stale,
+// which is nil if there was none, and saves it. If another order registered
+// one meanwhile, it is used instead.
+func registerAccount(ctx context.Context, ca ca, k *datastore.Key, stale *account) (*acme.Client, error) {
+	accountMu.Lock()
+	defer accountMu.Unlock()
+	a, err := loadAccount(ctx, k)
+	if err != nil {
+		return nil, err
+	}
+	if a != nil && a.KMSKey == accountKMSKey && (stale == nil || a.URI != stale.URI) {
+		key, err := loadAccountKey(ctx, *a)
+		if err != nil {
+			return nil, fmt.Errorf("account key: %v", err)
+		}
+		return newClient(ctx, ca.directory, key), nil
+	}
+
+	key, err := newAccountKey(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("account key: %v", err)
+	}
+	client := newClient(ctx, ca.directory, key)
+	eab, err := accountBinding(ctx, ca)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTOS(ctx, client, ca.envPrefix); err != nil {
+		return nil, err
+	}
+	opCtx, cancel := operationContext(ctx)
+	acct, err := client.Register(opCtx, &acme.Account{
+		Contact:                accountContact(),
+		ExternalAccountBinding: eab,
+	}, acme.AcceptTOS)
+	cancel()
+	if err != nil {
+		return nil, registerError(err, ca.envPrefix, eab)
+	}
+	a = &account{KMSKey: accountKMSKey, URI: acct.URI}
+	if k, ok := key.(*rsa.PrivateKey); ok {
+		a.Key = x509.MarshalPKCS1PrivateKey(k)
+	}
+	if _, err := datastore.Put(ctx, k, a); err != nil {
+		return nil, fmt.Errorf("datastore put: %v", err)
+	}
+	return client, nil
+}
+
+// newAccountKey returns a new account key: RSA 2048, or the KMS key version
+// accountKMSKey if set.
+func newAccountKey(ctx context.Context) (crypto.Signer, error) {
+	if accountKMSKey != "" {
+		return newKMSSigner(ctx, accountKMSKey)
+	}
+	return rsa.GenerateKey(rand.Reader, 2048)
+}
+
+// loadAccountKey returns the key of a saved account.
+func loadAccountKey(ctx context.Context, a account) (crypto.Signer, error) {
+	if a.KMSKey != "" {
+		return newKMSSigner(ctx, a.KMSKey)
+	}
+	return x509.ParsePKCS1PrivateKey(a.Key)
+}
+
+// acmeHTTPClient returns the HTTP client to reach CAs. It is a variable so
+// that a fake CA can be used instead, along with AELE_ACME_DIRECTORY.
+var acmeHTTPClient = httpClient
+
+// newClient returns an ACME client for a directory with an account key.
+func newClient(ctx context.Context, directory string, key crypto.Signer) *acme.Client {
+	return &acme.Client{
+		Key:          key,
+		HTTPClient:   acmeHTTPClient(ctx),
+		DirectoryURL: directory,
+		RetryBackoff: retryBackoff,
+		UserAgent:    userAgent(ctx),
+	}
+}
+
+// accountGone returns whether an account lookup failed because the account
+// does not exist or was deactivated.
+func accountGone(err error) bool {
+	if err == acme.ErrNoAccount {
+		return true
+	}
+	e, ok := err.(*acme.Error)
+	return ok && e.ProblemType == "urn:ietf:params:acme:error:unauthorized"
+}
+
+// externalAccountBinding returns the External Account Binding credentials
+// some CAs require to register, read from the <prefix>EAB_KID and
+// <prefix>EAB_HMAC_KEY (base64url encoded) environment variables, such as
+// AELE_EAB_KID and AELE_EAB_HMAC_KEY, or nil if unset.
+// <prefix>EAB_HMAC is accepted as an alias of <prefix>EAB_HMAC_KEY.
+func externalAccountBinding(prefix string) (*acme.ExternalAccountBinding, error) {
+	kid, hmac := os.Getenv(prefix+"EAB_KID"), os.Getenv(prefix+"EAB_HMAC_KEY")
+	if hmac == "" {
+		hmac = os.Getenv(prefix + "EAB_HMAC")
+	}
+	if kid == "" && hmac == "" {
+		return nil, nil
+	}
+	if kid == "" || hmac == "" {
+		return nil, fmt.Errorf("external account binding needs both %vEAB_KID and %vEAB_HMAC_KEY", prefix, prefix)
+	}
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(hmac, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %vEAB_HMAC_KEY, want base64url: %v", prefix, err)
+	}
+	return &acme.ExternalAccountBinding{KID: kid, Key: key}, nil
+}
+
+// checkTOS returns an error if the terms of service of the CA are not the
+// ones accepted with the <prefix>ACCEPTED_TOS_URL environment variable, such
+// as AELE_ACCEPTED_TOS_URL, if set, rather than accepting changed terms
+// without review. Otherwise terms are accepted.
+func checkTOS(ctx context.Context, client *acme.Client, prefix string) error {
+	accepted := os.Getenv(prefix + "ACCEPTED_TOS_URL")
+	if accepted == "" {
+		return nil
+	}
+	opCtx, cancel := operationContext(ctx)
+	dir, err := client.Discover(opCtx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("discover: %v", err)
+	}
+	if dir.Terms != accepted {
+		log.Warningf(ctx, "CA terms of service are now %v: review them and set %vACCEPTED_TOS_URL to accept them",
+			dir.Terms, prefix)
+		return fmt.Errorf("register: CA terms of service %v not accepted, %vACCEPTED_TOS_URL is %v",
+			dir.Terms, prefix, accepted)
+	}
+	return nil
+}
+
+// registerError explains registration errors due to External Account Binding.
+func registerError(err error, prefix string, eab *acme.ExternalAccountBinding) error {
+	e, ok := err.(*acme.Error)
+	switch {
+	case ok && e.ProblemType == "urn:ietf:params:acme:error:externalAccountRequired":
+		return fmt.Errorf("register: CA requires external account binding, "+
+			"set %vEAB_KID and %vEAB_HMAC_KEY: %v", prefix, prefix, err)
+	case ok && eab != nil && (e.ProblemType == "urn:ietf:params:acme:error:unauthorized" ||
+		e.ProblemType == "urn:ietf:params:acme:error:malformed"):
+		return fmt.Errorf("register: CA rejected external account binding %v, "+
+			"check %vEAB_KID and %vEAB_HMAC_KEY: %v", eab.KID, prefix, prefix, err)
+	}
+	return fmt.Errorf("register: %v", err)
+}
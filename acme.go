@@ -3,132 +3,461 @@ package aeletsencrypt
 import (
 	"context"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/pem"
 	"fmt"
 	"net/http"
+	"os"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/acme"
+	"golang.org/x/net/idna"
 	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/memcache"
-	"google.golang.org/appengine/urlfetch"
 )
 
-func init() {
-	http.HandleFunc("/.well-known/acme-challenge/", challengeHandler)
+// challengePath is the path the CA requests http-01 challenges at.
+const challengePath = "/.well-known/acme-challenge/"
+
+// challengePrefix is the path prefix the challenge handler is registered at.
+// It defaults to challengePath and is configurable with the
+// AELE_CHALLENGE_PATH environment variable, for apps routing challengePath to
+// another service or handler which forwards challenges to this prefix.
+var challengePrefix = challengeHandlerPrefix()
+
+// challengeHandlerPrefix returns the configured challenge handler prefix,
+// with leading and trailing slashes.
+func challengeHandlerPrefix() string {
+	prefix := os.Getenv("AELE_CHALLENGE_PATH")
+	if prefix == "" {
+		return challengePath
+	}
+	return "/" + strings.Trim(prefix, "/") + "/"
 }
 
+// challengeApp is, for apps whose custom domains are managed by another app
+// (see extraApps), the ID of that app to redirect challenges to, read from
+// the AELE_CHALLENGE_APP environment variable.
+var challengeApp = os.Getenv("AELE_CHALLENGE_APP")
+
 // challengeHandler responds to the http-01 challenge for domain validation.
+// Challenges are saved at the path the CA requests, whatever prefix the
+// handler is registered at.
 func challengeHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := appengine.NewContext(r)
-	item, err := memcache.Get(ctx, r.URL.Path)
+	token := strings.TrimPrefix(r.URL.Path, challengePrefix)
+	if challengeApp != "" {
+		// CAs follow redirects for http-01.
+		http.Redirect(w, r, "https://"+challengeApp+".appspot.com"+challengePath+token, http.StatusFound)
+		return
+	}
+	if challengePath+token == pingPath {
+		w.Header().Set(serviceHeader, appengine.ModuleName(ctx))
+		fmt.Fprint(w, appengine.AppID(ctx))
+		return
+	}
+	response, err := getChallenge(ctx, challengePath+token)
 	switch err {
 	case nil:
-		fmt.Fprint(w, string(item.Value))
+		fmt.Fprint(w, response)
 	case memcache.ErrCacheMiss:
 		http.NotFound(w, r)
 	default:
-		http.Error(w, fmt.Sprintf("memcache get: %v", err), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// stagingURL is the Directory endpoint of Let's Encrypt staging environment,
+// which issues untrusted certificates with higher rate limits for testing.
+const stagingURL = "https://acme-staging-v02.api.letsencrypt.org/directory"
+
+// staging returns whether Let's Encrypt staging environment is used,
+// set with the AELE_ACME_STAGING=1 environment variable.
+func staging() bool {
+	return os.Getenv("AELE_ACME_STAGING") == "1" && os.Getenv("AELE_ACME_DIRECTORY") == "" && !googleCA
+}
+
+// directoryURL returns the ACME directory to use: the AELE_ACME_DIRECTORY
+// environment variable for alternative CAs, or else Google Public CA if
+// selected, or else Let's Encrypt. AELE_ACME_STAGING=1 selects the staging
+// environment of either.
+func directoryURL() string {
+	if url := os.Getenv("AELE_ACME_DIRECTORY"); url != "" {
+		return url
+	}
+	if googleCA {
+		if os.Getenv("AELE_ACME_STAGING") == "1" {
+			return googleStagingURL
+		}
+		return googleURL
 	}
+	if staging() {
+		return stagingURL
+	}
+	return acme.LetsEncryptURL
 }
 
-// obtainCert creates a key and obtains a signed certificate.
-// It returns the signed certificate with chain and the key, both PEM encoded.
-// A temporary account key is created and domain validation done over http.
-func obtainCert(ctx context.Context, domain string) (cert, key string, err error) {
-	// "Private keys must use RSA encryption."
-	// "Maximum allowed key modulus: 2048 bits"
-	// https://cloud.google.com/appengine/docs/standard/python/using-custom-domains-and-ssl#app_engine_support_for_ssl_certificates
-	certKey, err := rsa.GenerateKey(rand.Reader, 2048)
+// mustStaple is whether certificates require OCSP stapling (RFC 7633), set
+// with the AELE_MUST_STAPLE=1 environment variable. It is only safe if the
+// serving layer staples OCSP responses, which AppEngine does not guarantee:
+// otherwise browsers enforcing it refuse the certificate. Some CAs, Let's
+// Encrypt included, no longer issue such certificates.
+var mustStaple = os.Getenv("AELE_MUST_STAPLE") == "1"
+
+// mustStapleExtension is the TLS Feature extension (id-pe-tlsfeature) with
+// the status_request feature, DER encoded as SEQUENCE { INTEGER 5 }.
+var mustStapleExtension = pkix.Extension{
+	Id:    asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24},
+	Value: []byte{0x30, 0x03, 0x02, 0x01, 0x05},
+}
+
+// ObtainCertificate creates a key and obtains a signed certificate for the
+// domains, the first one being the common name and all of them alternative
+// names, in Unicode or ASCII form. The key is of the type configured for the
+// first domain with AELE_KEY_TYPES, RSA of AELE_RSA_KEY_BITS (2048 by
+// default) otherwise, and reused across renewals with AELE_REUSE_KEY=1.
+// It returns the signed certificate with chain and the key, both PEM encoded,
+// leaving it to the caller to upload them.
+// The context must be an AppEngine request context.
+// If a fallback CA is configured, it is used when the primary one is rate
+// limiting or unavailable.
+// The account is reused across runs and domain validation done over http,
+// or over dns for wildcard domains. The http-01 challenge is
+// served by the handler this package registers at /.well-known/acme-challenge/
+// (or AELE_CHALLENGE_PATH); callers not routing this path to it are
+// responsible for serving the challenge themselves.
+func ObtainCertificate(ctx context.Context, domains []string) (cert, key string, err error) {
+	if len(domains) == 0 {
+		return "", "", fmt.Errorf("no domains")
+	}
+	ascii := make([]string, len(domains))
+	for i, domain := range domains {
+		if ascii[i], err = asciiDomain(domain); err != nil {
+			return "", "", err
+		}
+	}
+	domains = ascii
+	certKey, err := certificateKey(ctx, domains[0])
 	if err != nil {
 		return "", "", fmt.Errorf("cert key: %v", err)
 	}
 
+	if err := checkSignatureAlgorithm(csrSignatureAlgorithm, certKey); err != nil {
+		return "", "", err
+	}
 	req := &x509.CertificateRequest{
-		Subject: pkix.Name{CommonName: domain},
+		Subject:            pkix.Name{CommonName: domains[0]},
+		SignatureAlgorithm: csrSignatureAlgorithm,
+	}
+	req.DNSNames = domains
+	if mustStaple {
+		req.ExtraExtensions = append(req.ExtraExtensions, mustStapleExtension)
 	}
-	req.DNSNames = []string{domain}
 	csr, err := x509.CreateCertificateRequest(rand.Reader, req, certKey)
 	if err != nil {
 		return "", "", fmt.Errorf("csr: %v", err)
 	}
 
-	accountKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	var errs []string
+	for i, ca := range cas() {
+		certDER, err := obtainFrom(ctx, ca, domains, csr)
+		if err != nil {
+			if _, ok := err.(*unavailableError); ok && i < len(cas())-1 {
+				log.Warningf(ctx, "CA %v unavailable for %v, trying the next one: %v", ca.directory, domains, err)
+				errs = append(errs, fmt.Sprintf("%v: %v", ca.directory, err))
+				continue
+			}
+			if len(errs) == 0 {
+				return "", "", err
+			}
+			return "", "", classify(fmt.Errorf("%v; %v: %v", strings.Join(errs, "; "), ca.directory, err), err)
+		}
+		log.Infof(ctx, "certificate for %v issued by CA %v", domains, ca.directory)
+
+		var certPEM []byte
+		for _, b := range certDER {
+			b = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b})
+			certPEM = append(certPEM, b...)
+		}
+		certKeyPEM, err := encodeKey(certKey)
+		if err != nil {
+			return "", "", fmt.Errorf("cert key: %v", err)
+		}
+		return string(certPEM), string(certKeyPEM), nil
+	}
+	return "", "", fmt.Errorf("no CA")
+}
+
+// obtainFrom orders a certificate for the domains from a CA with a CSR,
+// returning the certificate chain DER encoded. Errors are unavailableError
+// when another CA can be tried.
+func obtainFrom(ctx context.Context, ca ca, domains []string, csr []byte) ([][]byte, error) {
+	client, err := accountClient(ctx, ca)
 	if err != nil {
-		return "", "", fmt.Errorf("account key: %v", err)
+		return nil, &unavailableError{err}
 	}
-	client := &acme.Client{
-		Key:          accountKey,
-		HTTPClient:   urlfetch.Client(ctx),
-		DirectoryURL: acme.LetsEncryptURL,
+	if ca.directory == stagingURL {
+		log.Warningf(ctx, "using Let's Encrypt staging, certificate for %v will not be trusted", domains)
 	}
-	if _, err = client.Register(ctx, &acme.Account{}, acme.AcceptTOS); err != nil {
-		return "", "", fmt.Errorf("register: %v", err)
+	opCtx, cancel := operationContext(ctx)
+	err = checkProfile(opCtx, client)
+	cancel()
+	if err != nil {
+		return nil, err
 	}
 
-	if err := authorize(ctx, client, domain); err != nil {
-		return "", "", err
+	opCtx, cancel = operationContext(ctx)
+	order, err := client.AuthorizeOrder(opCtx, acme.DomainIDs(domains...))
+	cancel()
+	if err != nil {
+		return nil, unavailable(classify(fmt.Errorf("authorize order: %v", withRetryAfter(err)), err), err)
+	}
+	if order.Status == acme.StatusReady {
+		// The CA reused valid authorizations of the account for all domains.
+		log.Infof(ctx, "order for %v ready, reusing valid authorizations", domains)
+	} else {
+		for _, url := range order.AuthzURLs {
+			if err := authorize(ctx, client, url); err != nil {
+				return nil, err
+			}
+		}
+	}
+	opCtx, cancel = operationContext(ctx)
+	order, err = client.WaitOrder(opCtx, order.URI)
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("wait order: %v", err)
 	}
 
-	const expiry = 90 * 24 * time.Hour // 90 days, desired
 	const bundle = true
-	certDER, _, err := client.CreateCert(ctx, csr, expiry, bundle)
+	opCtx, cancel = operationContext(ctx)
+	certDER, certURL, err := client.CreateOrderCert(opCtx, order.FinalizeURL, csr, bundle)
+	cancel()
+	if err != nil {
+		return nil, unavailable(classify(fmt.Errorf("create cert: %v", withRetryAfter(err)), err), err)
+	}
+	if len(certDER) == 0 {
+		return nil, fmt.Errorf("create cert: no certificate")
+	}
+	if err := checkSCT(ctx, certDER[0]); err != nil {
+		return nil, err
+	}
+	if certDER, err = selectChain(ctx, client, certURL, certDER); err != nil {
+		return nil, fmt.Errorf("select chain: %v", err)
+	}
+	return certDER, nil
+}
+
+// asciiDomain returns the ASCII (punycode) form of a domain, possibly
+// internationalized (e.g. café.example) or a wildcard, as CAs expect.
+func asciiDomain(domain string) (string, error) {
+	prefix := ""
+	if strings.HasPrefix(domain, "*.") {
+		prefix, domain = "*.", domain[2:]
+	}
+	a, err := idna.Lookup.ToASCII(domain)
 	if err != nil {
-		return "", "", fmt.Errorf("create cert: %v", err)
+		return "", fmt.Errorf("invalid domain %v: %v", domain, err)
 	}
+	return prefix + a, nil
+}
+
+// operationTimeout is the timeout of each ACME operation, so that a CA not
+// responding fails the domain rather than the whole run. It defaults to 60
+// seconds and is configurable with the AELE_ACME_TIMEOUT_SECONDS environment
+// variable, from 1 to 600.
+var operationTimeout = time.Duration(envInt("AELE_ACME_TIMEOUT_SECONDS", 60, 1, 600)) * time.Second
+
+// operationContext returns a context for an ACME operation, with
+// operationTimeout.
+func operationContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, operationTimeout)
+}
+
+// cleanupTimeout bounds cleanups running after their request was canceled.
+const cleanupTimeout = 30 * time.Second
+
+// cleanup runs a cleanup such as deleting challenges with a context with the
+// values of ctx, like the AppEngine API ticket, but not canceled with it, so
+// that it still runs when the request is canceled, within cleanupTimeout.
+func cleanup(ctx context.Context, f func(context.Context)) {
+	ctx, cancel := context.WithTimeout(detachedContext{ctx}, cleanupTimeout)
+	defer cancel()
+	f(ctx)
+}
+
+// detachedContext is a context with the values of another one, but neither
+// its deadline nor its cancellation.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
 
-	var certPEM []byte
-	for _, b := range certDER {
-		b = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b})
-		certPEM = append(certPEM, b...)
+// withRetryAfter adds to a rate limit error when the CA allows to retry,
+// if it tells.
+func withRetryAfter(err error) error {
+	if d, ok := acme.RateLimit(err); ok && d > 0 {
+		return fmt.Errorf("%v (retry after %v)", err, time.Now().Add(d).UTC().Format(time.RFC3339))
 	}
-	certKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(certKey)})
+	return err
+}
 
-	return string(certPEM), string(certKeyPEM), nil
+// challengeTypes are the challenge types used to validate domains, in order
+// of preference, read from the comma-separated AELE_CHALLENGE_TYPES
+// environment variable among http-01, dns-01 and tls-alpn-01. It defaults to
+// http-01, followed by tls-alpn-01 with tlsALPN.
+var challengeTypes = envChallengeTypes("AELE_CHALLENGE_TYPES")
+
+// envChallengeTypes reads challenge types from an environment variable,
+// recording invalid values in configErr.
+func envChallengeTypes(name string) []string {
+	types := envList(name)
+	if len(types) == 0 {
+		types = []string{"http-01"}
+		if tlsALPN {
+			types = append(types, "tls-alpn-01")
+		}
+		return types
+	}
+	for _, t := range types {
+		switch t {
+		case "http-01", "dns-01", "tls-alpn-01":
+		default:
+			if configErr == nil {
+				configErr = fmt.Errorf("invalid %v: unknown challenge type %q, "+
+					"must be http-01, dns-01 or tls-alpn-01", name, t)
+			}
+			return []string{"http-01"}
+		}
+	}
+	return types
 }
 
-// authorize authorizes the client to issue certificates for this domain
-// by going through the http-01 challenge.
-func authorize(ctx context.Context, client *acme.Client, domain string) error {
-	authorization, err := client.Authorize(ctx, domain)
+// pickChallenge returns the offered challenge of the first type offered, or
+// nil if none is.
+func pickChallenge(offered []*acme.Challenge, types []string) *acme.Challenge {
+	for _, t := range types {
+		for _, c := range offered {
+			if c.Type == t {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// authorize fulfills an order authorization, allowing the client to issue
+// certificates for its domain by going through the first challenge offered
+// among challengeTypes. Wildcard authorizations go through dns-01 instead,
+// the only challenge CAs validate them with, so an order for a domain and
+// its wildcard may mix both.
+func authorize(ctx context.Context, client *acme.Client, url string) error {
+	opCtx, cancel := operationContext(ctx)
+	authorization, err := client.GetAuthorization(opCtx, url)
+	cancel()
 	if err != nil {
-		return fmt.Errorf("authorize: %v", err)
+		return fmt.Errorf("get authorization: %v", err)
 	}
 	if authorization.Status == acme.StatusValid {
+		// CAs reuse valid authorizations of the account for a while, e.g.
+		// 30 days for Let's Encrypt, so no challenge is needed.
+		log.Infof(ctx, "authorization for %v valid until %v, reusing", authorization.Identifier.Value, authorization.Expires)
 		return nil
 	}
 
-	var challenge *acme.Challenge
-	for _, c := range authorization.Challenges {
-		if c.Type == "http-01" {
-			challenge = c
-			break
-		}
+	types := challengeTypes
+	if authorization.Wildcard {
+		types = []string{"dns-01"}
 	}
+	challenge := pickChallenge(authorization.Challenges, types)
 	if challenge == nil {
-		return fmt.Errorf("no http-01 challenge offered")
+		return fmt.Errorf("no %v challenge offered", strings.Join(types, " or "))
 	}
 
-	response, err := client.HTTP01ChallengeResponse(challenge.Token)
-	if err != nil {
-		return fmt.Errorf("challenge response: %v", err)
-	}
-	if err := memcache.Set(ctx, &memcache.Item{
-		Key:   client.HTTP01ChallengePath(challenge.Token),
-		Value: []byte(response),
-	}); err != nil {
-		return fmt.Errorf("memcache set: %v", err)
+	// Challenges are cleaned up whatever happens, even if ctx is canceled,
+	// e.g. when the run is aborted, so their responses do not linger.
+	switch challenge.Type {
+	case "http-01":
+		response, err := client.HTTP01ChallengeResponse(challenge.Token)
+		if err != nil {
+			return fmt.Errorf("challenge response: %v", err)
+		}
+		path := client.HTTP01ChallengePath(challenge.Token)
+		if err := putChallenge(ctx, path, response); err != nil {
+			return err
+		}
+		defer cleanup(ctx, func(ctx context.Context) { deleteChallenge(ctx, path) })
+		if err := servedChallenge(ctx, authorization.Identifier.Value, path, response); err != nil {
+			return err
+		}
+	case "dns-01":
+		record, err := client.DNS01ChallengeRecord(challenge.Token)
+		if err != nil {
+			return fmt.Errorf("challenge record: %v", err)
+		}
+		name := "_acme-challenge." + authorization.Identifier.Value + "."
+		if err := updateRecord(ctx, name, record, true); err != nil {
+			return fmt.Errorf("dns add: %v", err)
+		}
+		defer cleanup(ctx, func(ctx context.Context) { updateRecord(ctx, name, record, false) })
+	case "tls-alpn-01":
+		if err := putTLSALPNCert(ctx, client, challenge.Token, authorization.Identifier.Value); err != nil {
+			return err
+		}
+		defer cleanup(ctx, func(ctx context.Context) {
+			deleteChallenge(ctx, tlsALPNKey(authorization.Identifier.Value))
+		})
 	}
 
-	if _, err := client.Accept(ctx, challenge); err != nil {
+	opCtx, cancel = operationContext(ctx)
+	_, err = client.Accept(opCtx, challenge)
+	cancel()
+	if err != nil {
 		return fmt.Errorf("accept challenge: %v", err)
 	}
-	if _, err = client.WaitAuthorization(ctx, authorization.URI); err != nil {
-		return fmt.Errorf("authorization: %v", err)
+	opCtx, cancel = operationContext(ctx)
+	_, err = client.WaitAuthorization(opCtx, authorization.URI)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("authorization: %v", challengeError(ctx, client, challenge, err))
 	}
 	return nil
 }
+
+// challengeError explains a failed authorization with the reason the CA gives
+// for its challenge failing (e.g. DNS problem: NXDOMAIN), fetching the
+// challenge if the authorization does not include it.
+func challengeError(ctx context.Context, client *acme.Client, challenge *acme.Challenge, err error) error {
+	authzErr, ok := err.(*acme.AuthorizationError)
+	if !ok {
+		return err
+	}
+	errs := authzErr.Errors
+	if len(errs) == 0 {
+		opCtx, cancel := operationContext(ctx)
+		c, e := client.GetChallenge(opCtx, challenge.URI)
+		cancel()
+		if e == nil && c.Error != nil {
+			errs = append(errs, c.Error)
+		}
+	}
+	var details []string
+	for _, e := range errs {
+		if e, ok := e.(*acme.Error); ok && e.Detail != "" {
+			details = append(details, fmt.Sprintf("%v (%v)", e.Detail, e.ProblemType))
+			continue
+		}
+		details = append(details, e.Error())
+	}
+	if len(details) == 0 {
+		return err
+	}
+	return fmt.Errorf("%v challenge for %v failed: %v", challenge.Type, authzErr.Identifier, strings.Join(details, "; "))
+}
@@ -0,0 +1,197 @@
+package aeletsencrypt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestObtainCertificate(t *testing.T) {
+	ctx, f := newTestContext(t)
+	ca := newTestCA(t, ctx)
+	domains := []string{"example.com", "www.example.com"}
+	cert, key, err := ObtainCertificate(ctx, domains)
+	if err != nil {
+		t.Fatalf("ObtainCertificate: %v", err)
+	}
+	if _, err := tls.X509KeyPair([]byte(cert), []byte(key)); err != nil {
+		t.Errorf("key pair: %v", err)
+	}
+	chain, err := parseChain(cert)
+	if err != nil {
+		t.Fatalf("parse chain: %v", err)
+	}
+	if got := chain[0].DNSNames; !reflect.DeepEqual(got, domains) {
+		t.Errorf("certificate names: got %v, want %v", got, domains)
+	}
+	roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+	roots.AddCert(ca.root)
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+	if _, err := chain[0].Verify(x509.VerifyOptions{DNSName: "www.example.com", Roots: roots, Intermediates: intermediates}); err != nil {
+		t.Errorf("verify chain: %v", err)
+	}
+	if want := []string{"http-01 example.com", "http-01 www.example.com"}; !reflect.DeepEqual(ca.accepted, want) {
+		t.Errorf("accepted challenges: got %v, want %v", ca.accepted, want)
+	}
+	if n := f.count(challengeKind) + len(f.memcache); n != 0 {
+		t.Errorf("%v challenges left after authorization", n)
+	}
+}
+
+func TestObtainCertificateUnicode(t *testing.T) {
+	ctx, _ := newTestContext(t)
+	ca := newTestCA(t, ctx)
+	var fetched []string
+	fetch := ca.fetch
+	ca.fetch = func(domain, path string) (string, error) {
+		fetched = append(fetched, domain)
+		return fetch(domain, path)
+	}
+	if _, _, err := ObtainCertificate(ctx, []string{"café.example"}); err != nil {
+		t.Fatalf("ObtainCertificate: %v", err)
+	}
+	if len(ca.csrs) != 1 {
+		t.Fatalf("got %v orders finalized, want 1", len(ca.csrs))
+	}
+	want := []string{"xn--caf-dma.example"}
+	if got := ca.csrs[0].DNSNames; !reflect.DeepEqual(got, want) {
+		t.Errorf("CSR names: got %v, want %v", got, want)
+	}
+	if !reflect.DeepEqual(fetched, want) {
+		t.Errorf("challenges fetched from %v, want %v", fetched, want)
+	}
+	if want := []string{"http-01 xn--caf-dma.example"}; !reflect.DeepEqual(ca.accepted, want) {
+		t.Errorf("accepted challenges: got %v, want %v", ca.accepted, want)
+	}
+}
+
+func TestObtainCertificateChallengeFailed(t *testing.T) {
+	ctx, _ := newTestContext(t)
+	ca := newTestCA(t, ctx)
+	ca.fetch = func(domain, path string) (string, error) {
+		return "", errors.New("404 Not Found")
+	}
+	_, _, err := ObtainCertificate(ctx, []string{"example.com"})
+	if err == nil {
+		t.Fatal("ObtainCertificate: got nil error")
+	}
+	for _, want := range []string{"http-01 challenge for example.com failed", "404 Not Found", "unauthorized"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+	if len(ca.csrs) != 0 {
+		t.Errorf("order finalized despite the failed challenge")
+	}
+}
+
+func TestObtainCertificateRateLimited(t *testing.T) {
+	ctx, _ := newTestContext(t)
+	ca := newTestCA(t, ctx)
+	ca.rateLimited = true
+	_, _, err := ObtainCertificate(ctx, []string{"example.com"})
+	if err == nil {
+		t.Fatal("ObtainCertificate: got nil error")
+	}
+	if status := errorStatus(err); status != http.StatusTooManyRequests {
+		t.Errorf("error %q status: got %v, want %v", err, status, http.StatusTooManyRequests)
+	}
+	if !strings.Contains(err.Error(), "retry after") {
+		t.Errorf("error %q does not tell when to retry", err)
+	}
+}
+
+func TestObtainCertificateProfile(t *testing.T) {
+	ctx, _ := newTestContext(t)
+	newTestCA(t, ctx)
+	restore := acmeProfile
+	defer func() { acmeProfile = restore }()
+
+	acmeProfile = "shortlived"
+	if _, _, err := ObtainCertificate(ctx, []string{"example.com"}); err != nil {
+		t.Errorf("ObtainCertificate with an offered profile: %v", err)
+	}
+	acmeProfile = "longlived"
+	_, _, err := ObtainCertificate(ctx, []string{"example.com"})
+	if err == nil || !strings.Contains(err.Error(), "offers classic, shortlived") {
+		t.Errorf("ObtainCertificate with an unknown profile: got %v, want the offered profiles", err)
+	}
+}
+
+func TestASCIIDomain(t *testing.T) {
+	for _, tt := range []struct {
+		domain, want string
+	}{
+		{"example.com", "example.com"},
+		{"café.example", "xn--caf-dma.example"},
+		{"*.café.example", "*.xn--caf-dma.example"},
+		{"xn--caf-dma.example", "xn--caf-dma.example"},
+	} {
+		got, err := asciiDomain(tt.domain)
+		if err != nil {
+			t.Errorf("asciiDomain(%q): %v", tt.domain, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("asciiDomain(%q): got %q, want %q", tt.domain, got, tt.want)
+		}
+	}
+	if _, err := asciiDomain("exa_mple.com"); err == nil {
+		t.Errorf("asciiDomain(%q): got nil error", "exa_mple.com")
+	}
+}
+
+func TestObtainCertificateWildcard(t *testing.T) {
+	ctx, _ := newTestContext(t)
+	ca := newTestCA(t, ctx)
+	domains := []string{"example.com", "*.example.com"}
+	cert, _, err := ObtainCertificate(ctx, domains)
+	if err != nil {
+		t.Fatalf("ObtainCertificate: %v", err)
+	}
+	chain, err := parseChain(cert)
+	if err != nil {
+		t.Fatalf("parse chain: %v", err)
+	}
+	if got := chain[0].DNSNames; !reflect.DeepEqual(got, domains) {
+		t.Errorf("certificate names: got %v, want %v", got, domains)
+	}
+	// The wildcard authorization is the only one validated over dns.
+	if want := []string{"http-01 example.com", "dns-01 example.com"}; !reflect.DeepEqual(ca.accepted, want) {
+		t.Errorf("accepted challenges: got %v, want %v", ca.accepted, want)
+	}
+	for name, values := range ca.records {
+		if len(values) != 0 {
+			t.Errorf("TXT record %v left after authorization: %v", name, values)
+		}
+	}
+}
+
+func TestObtainCertificateReusesAuthorizations(t *testing.T) {
+	ctx, _ := newTestContext(t)
+	ca := newTestCA(t, ctx)
+	if _, _, err := ObtainCertificate(ctx, []string{"example.com"}); err != nil {
+		t.Fatalf("ObtainCertificate: %v", err)
+	}
+	// The valid authorization of example.com is reused, only the one of
+	// www.example.com needs a challenge.
+	if _, _, err := ObtainCertificate(ctx, []string{"example.com", "www.example.com"}); err != nil {
+		t.Fatalf("ObtainCertificate: %v", err)
+	}
+	// All authorizations are valid: the order is ready, without challenges.
+	if _, _, err := ObtainCertificate(ctx, []string{"www.example.com", "example.com"}); err != nil {
+		t.Fatalf("ObtainCertificate: %v", err)
+	}
+	if want := []string{"http-01 example.com", "http-01 www.example.com"}; !reflect.DeepEqual(ca.accepted, want) {
+		t.Errorf("accepted challenges: got %v, want %v", ca.accepted, want)
+	}
+	if len(ca.csrs) != 3 {
+		t.Errorf("got %v orders finalized, want 3", len(ca.csrs))
+	}
+}
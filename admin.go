@@ -0,0 +1,154 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2/google"
+	api "google.golang.org/api/appengine/v1beta"
+)
+
+// admin is the subset of the AppEngine Admin API used to manage custom
+// domain certificates, so that it can be replaced, e.g. by a fake.
+type admin interface {
+	// GetApp returns the app, with its location.
+	GetApp(appID string) (*api.Application, error)
+
+	ListDomainMappings(appID string) ([]*api.DomainMapping, error)
+	GetDomainMapping(appID, domain string) (*api.DomainMapping, error)
+	// SetDomainCertificate maps a certificate to a domain, leaving the rest
+	// of the mapping untouched.
+	SetDomainCertificate(appID, domain, certID string) error
+
+	// ListCertificates lists certificates with their public certificate.
+	ListCertificates(appID string) ([]*api.AuthorizedCertificate, error)
+	GetCertificate(appID, certID string) (*api.AuthorizedCertificate, error)
+	CreateCertificate(appID string, c *api.AuthorizedCertificate) (*api.AuthorizedCertificate, error)
+	// UpdateCertificate replaces the display name, certificate and key of a
+	// certificate.
+	UpdateCertificate(appID, certID, displayName, cert, key string) error
+	DeleteCertificate(appID, certID string) error
+}
+
+// newAdmin returns the admin implementation to use. It is a variable so that
+// the Admin API can be replaced, e.g. by a fake.
+var newAdmin = adminService
+
+// adminService returns an AppEngine Admin API client as the AppEngine default
+// service account.
+func adminService(ctx context.Context) (admin, error) {
+	client, err := google.DefaultClient(ctx, api.CloudPlatformScope)
+	if err != nil {
+		return nil, fmt.Errorf("default client: %v", err)
+	}
+	svc, err := api.New(retryClient(client))
+	if err != nil {
+		return nil, fmt.Errorf("api client: %v", err)
+	}
+	svc.UserAgent = userAgent(ctx)
+	return &adminAPI{ctx, svc}, nil
+}
+
+// adminAPI implements admin with the AppEngine Admin API.
+type adminAPI struct {
+	ctx context.Context // of the request, to stop waiting for operations
+	svc *api.APIService
+}
+
+func (a *adminAPI) GetApp(appID string) (*api.Application, error) {
+	return a.svc.Apps.Get(appID).Do()
+}
+
+func (a *adminAPI) ListDomainMappings(appID string) ([]*api.DomainMapping, error) {
+	dm, err := a.svc.Apps.DomainMappings.List(appID).Do()
+	if err != nil {
+		return nil, err
+	}
+	return dm.DomainMappings, nil
+}
+
+func (a *adminAPI) GetDomainMapping(appID, domain string) (*api.DomainMapping, error) {
+	return a.svc.Apps.DomainMappings.Get(appID, domain).Do()
+}
+
+func (a *adminAPI) SetDomainCertificate(appID, domain, certID string) error {
+	op, err := a.svc.Apps.DomainMappings.Patch(appID, domain, &api.DomainMapping{
+		SslSettings: &api.SslSettings{
+			CertificateId: certID,
+		},
+	}).UpdateMask("ssl_settings.certificate_id").Do()
+	if err != nil {
+		return err
+	}
+	return a.wait(a.ctx, appID, op)
+}
+
+// adminOperationTimeout bounds waiting for a long-running operation of the
+// Admin API, polled every adminOperationPoll.
+const (
+	adminOperationTimeout = 2 * time.Minute
+	adminOperationPoll    = 2 * time.Second
+)
+
+// wait polls a long-running operation until it is done, so that a change is
+// not reported as done while still in progress, returning its error if any.
+// Certificates are created synchronously, but domain mappings are patched
+// with an operation. It stops waiting when ctx is done.
+func (a *adminAPI) wait(ctx context.Context, appID string, op *api.Operation) error {
+	deadline := time.Now().Add(adminOperationTimeout)
+	for !op.Done {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("operation %v not done after %v", op.Name, adminOperationTimeout)
+		}
+		t := time.NewTimer(adminOperationPoll)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return fmt.Errorf("operation %v: %v", op.Name, ctx.Err())
+		case <-t.C:
+		}
+		id := op.Name[strings.LastIndex(op.Name, "/")+1:]
+		var err error
+		if op, err = a.svc.Apps.Operations.Get(appID, id).Context(ctx).Do(); err != nil {
+			return fmt.Errorf("get operation: %v", err)
+		}
+	}
+	if op.Error != nil {
+		return fmt.Errorf("operation %v: %v", op.Name, op.Error.Message)
+	}
+	return nil
+}
+
+func (a *adminAPI) ListCertificates(appID string) ([]*api.AuthorizedCertificate, error) {
+	ac, err := a.svc.Apps.AuthorizedCertificates.List(appID).View("FULL_CERTIFICATE").Do()
+	if err != nil {
+		return nil, err
+	}
+	return ac.Certificates, nil
+}
+
+func (a *adminAPI) GetCertificate(appID, certID string) (*api.AuthorizedCertificate, error) {
+	return a.svc.Apps.AuthorizedCertificates.Get(appID, certID).Do()
+}
+
+func (a *adminAPI) CreateCertificate(appID string, c *api.AuthorizedCertificate) (*api.AuthorizedCertificate, error) {
+	return a.svc.Apps.AuthorizedCertificates.Create(appID, c).Do()
+}
+
+func (a *adminAPI) UpdateCertificate(appID, certID, displayName, cert, key string) error {
+	_, err := a.svc.Apps.AuthorizedCertificates.Patch(appID, certID, &api.AuthorizedCertificate{
+		CertificateRawData: &api.CertificateRawData{
+			PrivateKey:        key,
+			PublicCertificate: cert,
+		},
+		DisplayName: displayName,
+	}).UpdateMask("certificate_raw_data,display_name").Do()
+	return err
+}
+
+func (a *adminAPI) DeleteCertificate(appID, certID string) error {
+	_, err := a.svc.Apps.AuthorizedCertificates.Delete(appID, certID).Do()
+	return err
+}
@@ -0,0 +1,218 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	api "google.golang.org/api/appengine/v1beta"
+	"google.golang.org/api/googleapi"
+)
+
+// fakeAdmin implements admin in memory for one app.
+type fakeAdmin struct {
+	mu       sync.Mutex
+	getApps  int                                   // calls to GetApp
+	mappings map[string]*api.DomainMapping         // by domain
+	certs    map[string]*api.AuthorizedCertificate // by ID
+	lastID   int
+	created  []string // IDs of created certificates, in order
+	updated  []string // IDs of updated certificates, in order
+}
+
+// newFakeAdmin returns a fake admin with domain mappings and certificates,
+// and has the package use it.
+func newFakeAdmin(t *testing.T, mappings []*api.DomainMapping, certs []*api.AuthorizedCertificate) *fakeAdmin {
+	a := &fakeAdmin{mappings: map[string]*api.DomainMapping{}, certs: map[string]*api.AuthorizedCertificate{}}
+	for _, m := range mappings {
+		a.mappings[m.Id] = m
+	}
+	for _, c := range certs {
+		a.certs[c.Id] = c
+	}
+	restore := newAdmin
+	newAdmin = func(context.Context) (admin, error) { return a, nil }
+	t.Cleanup(func() { newAdmin = restore })
+	return a
+}
+
+func (a *fakeAdmin) GetApp(appID string) (*api.Application, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.getApps++
+	return &api.Application{Id: appID, LocationId: "us-central"}, nil
+}
+
+func (a *fakeAdmin) ListDomainMappings(appID string) ([]*api.DomainMapping, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var list []*api.DomainMapping
+	for _, m := range a.mappings {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list, nil
+}
+
+func (a *fakeAdmin) GetDomainMapping(appID, domain string) (*api.DomainMapping, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	m, ok := a.mappings[domain]
+	if !ok {
+		return nil, &googleapi.Error{Code: http.StatusNotFound, Message: "domain mapping not found"}
+	}
+	return m, nil
+}
+
+func (a *fakeAdmin) SetDomainCertificate(appID, domain, certID string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	m, ok := a.mappings[domain]
+	if !ok {
+		return &googleapi.Error{Code: http.StatusNotFound, Message: "domain mapping not found"}
+	}
+	if m.SslSettings == nil {
+		m.SslSettings = &api.SslSettings{}
+	}
+	m.SslSettings.CertificateId = certID
+	return nil
+}
+
+func (a *fakeAdmin) ListCertificates(appID string) ([]*api.AuthorizedCertificate, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var list []*api.AuthorizedCertificate
+	for _, c := range a.certs {
+		c.DomainMappingsCount = 0
+		for _, m := range a.mappings {
+			if m.SslSettings != nil && m.SslSettings.CertificateId == c.Id {
+				c.DomainMappingsCount++
+			}
+		}
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list, nil
+}
+
+func (a *fakeAdmin) GetCertificate(appID, certID string) (*api.AuthorizedCertificate, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	c, ok := a.certs[certID]
+	if !ok {
+		return nil, &googleapi.Error{Code: http.StatusNotFound, Message: "certificate not found"}
+	}
+	return c, nil
+}
+
+func (a *fakeAdmin) CreateCertificate(appID string, c *api.AuthorizedCertificate) (*api.AuthorizedCertificate, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.lastID++
+	created := &api.AuthorizedCertificate{Id: fmt.Sprint(a.lastID), DisplayName: c.DisplayName}
+	if err := setFakeCert(created, c.CertificateRawData.PublicCertificate); err != nil {
+		return nil, err
+	}
+	a.certs[created.Id] = created
+	a.created = append(a.created, created.Id)
+	return created, nil
+}
+
+func (a *fakeAdmin) UpdateCertificate(appID, certID, displayName, cert, key string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	c, ok := a.certs[certID]
+	if !ok {
+		return &googleapi.Error{Code: http.StatusNotFound, Message: "certificate not found"}
+	}
+	c.DisplayName = displayName
+	a.updated = append(a.updated, certID)
+	return setFakeCert(c, cert)
+}
+
+func (a *fakeAdmin) DeleteCertificate(appID, certID string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.certs, certID)
+	return nil
+}
+
+// setFakeCert sets a PEM encoded certificate with its chain to an uploaded
+// certificate, with its domains and expiry like the Admin API.
+func setFakeCert(c *api.AuthorizedCertificate, cert string) error {
+	chain, err := parseChain(cert)
+	if err != nil {
+		return &googleapi.Error{Code: http.StatusBadRequest, Message: err.Error()}
+	}
+	c.DomainNames = chain[0].DNSNames
+	c.ExpireTime = chain[0].NotAfter.UTC().Format(time.RFC3339)
+	c.CertificateRawData = &api.CertificateRawData{PublicCertificate: cert}
+	return nil
+}
+
+// testCertificate returns an uploaded certificate for domains, marked as
+// uploaded by this package, expiring in a duration.
+func testCertificate(t *testing.T, id string, domains []string, expiresIn time.Duration) *api.AuthorizedCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: domains[0]},
+		DNSNames:     domains,
+		NotBefore:    time.Now().Add(expiresIn - 90*24*time.Hour),
+		NotAfter:     time.Now().Add(expiresIn),
+	}, &x509.Certificate{Subject: pkix.Name{CommonName: "Test Issuer"}}, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &api.AuthorizedCertificate{Id: id, DisplayName: displayName(domains[0])}
+	if err := setFakeCert(c, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestSetDomainCertificate(t *testing.T) {
+	var method, path, mask, body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		method, path, mask, body = r.Method, r.URL.Path, r.FormValue("updateMask"), string(b)
+		fmt.Fprint(w, `{"name": "apps/testapp/operations/1", "done": true}`)
+	}))
+	defer srv.Close()
+	svc, err := api.New(srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.BasePath = srv.URL + "/"
+	a := &adminAPI{context.Background(), svc}
+	if err := a.SetDomainCertificate(testAppID, "example.com", "1"); err != nil {
+		t.Fatalf("SetDomainCertificate: %v", err)
+	}
+	// Only the certificate is patched, not the resource records nor routing.
+	if method != "PATCH" || path != "/v1beta/apps/testapp/domainMappings/example.com" {
+		t.Errorf("request %v %v, want PATCH of the domain mapping", method, path)
+	}
+	if mask != "ssl_settings.certificate_id" {
+		t.Errorf("update mask %q, want ssl_settings.certificate_id", mask)
+	}
+	if want := `{"sslSettings":{"certificateId":"1"}}`; strings.TrimSpace(body) != want {
+		t.Errorf("body %v, want %v", body, want)
+	}
+}
@@ -0,0 +1,218 @@
+package aeletsencrypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/remote_api"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// testAppID is the ID of the app of test contexts.
+const testAppID = "testapp"
+
+// fakeAppEngine implements the AppEngine APIs the package uses in memory:
+// Datastore entities by key, with transactions always committing and
+// queries returning no results, and memcache items without expiration.
+// URL Fetch requests are made with net/http.
+type fakeAppEngine struct {
+	mu       sync.Mutex
+	entities map[string][]byte // marshaled entity by marshaled key
+	kinds    map[string]string // kind by marshaled key
+	lastID   int64
+	memcache map[string][]byte // value by key
+}
+
+// newTestContext returns an AppEngine context for tests, logging with the
+// log package and calling the fake AppEngine APIs.
+func newTestContext(t *testing.T) (context.Context, *fakeAppEngine) {
+	// A remote_api context is the only way to have logs and the app ID
+	// outside AppEngine. It only needs the app ID from the server; API calls
+	// are then handled in memory.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "{app_id: %v, rtok: %v}", testAppID, r.FormValue("rtok"))
+	}))
+	t.Cleanup(srv.Close)
+	ctx, err := remote_api.NewRemoteContext(strings.Replace(srv.Listener.Addr().String(), "127.0.0.1", "localhost", 1), srv.Client())
+	if err != nil {
+		t.Fatalf("remote context: %v", err)
+	}
+	f := &fakeAppEngine{entities: map[string][]byte{}, kinds: map[string]string{}, memcache: map[string][]byte{}}
+	return appengine.WithAPICallFunc(ctx, f.call), f
+}
+
+// call handles an AppEngine API call, see appengine.APICallFunc.
+func (f *fakeAppEngine) call(ctx context.Context, service, method string, in, out proto.Message) error {
+	if service+"."+method == "urlfetch.Fetch" {
+		return fetch(proto.MessageReflect(in), proto.MessageReflect(out))
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	req, res := proto.MessageReflect(in), proto.MessageReflect(out)
+	switch service + "." + method {
+	case "datastore_v3.Get":
+		keys := field(req, "key").List()
+		entities := mutable(res, "entity").List()
+		for i := 0; i < keys.Len(); i++ {
+			result := entities.NewElement()
+			if b, ok := f.entities[marshal(keys.Get(i).Message())]; ok {
+				if err := proto.Unmarshal(b, proto.MessageV1(mutable(result.Message(), "entity").Message().Interface())); err != nil {
+					return err
+				}
+			}
+			entities.Append(result)
+		}
+	case "datastore_v3.Put":
+		entities := field(req, "entity").List()
+		keys := mutable(res, "key").List()
+		for i := 0; i < entities.Len(); i++ {
+			entity := proto.MessageReflect(proto.Clone(proto.MessageV1(entities.Get(i).Message().Interface())))
+			key := mutable(entity, "key").Message()
+			path := mutable(mutable(key, "path").Message(), "element").List()
+			last := path.Get(path.Len() - 1).Message()
+			if !last.Has(fieldDesc(last, "id")) && !last.Has(fieldDesc(last, "name")) {
+				f.lastID++
+				last.Set(fieldDesc(last, "id"), protoreflect.ValueOfInt64(f.lastID))
+			}
+			f.entities[marshal(key)] = []byte(marshal(entity))
+			keys.Append(protoreflect.ValueOfMessage(key))
+		}
+	case "datastore_v3.Delete":
+		keys := field(req, "key").List()
+		for i := 0; i < keys.Len(); i++ {
+			delete(f.entities, marshal(keys.Get(i).Message()))
+		}
+	case "datastore_v3.BeginTransaction":
+		res.Set(fieldDesc(res, "handle"), protoreflect.ValueOfUint64(1))
+		res.Set(fieldDesc(res, "app"), protoreflect.ValueOfString(testAppID))
+	case "datastore_v3.Commit", "datastore_v3.Rollback", "datastore_v3.RunQuery", "datastore_v3.Next":
+	case "memcache.Set":
+		items := field(req, "item").List()
+		statuses := mutable(res, "set_status").List()
+		for i := 0; i < items.Len(); i++ {
+			item := items.Get(i).Message()
+			f.memcache[string(field(item, "key").Bytes())] = field(item, "value").Bytes()
+			statuses.Append(protoreflect.ValueOfEnum(1)) // STORED
+		}
+	case "memcache.Get":
+		keys := field(req, "key").List()
+		items := mutable(res, "item").List()
+		for i := 0; i < keys.Len(); i++ {
+			key := keys.Get(i).Bytes()
+			value, ok := f.memcache[string(key)]
+			if !ok {
+				continue
+			}
+			item := items.NewElement()
+			item.Message().Set(fieldDesc(item.Message(), "key"), protoreflect.ValueOfBytes(key))
+			item.Message().Set(fieldDesc(item.Message(), "value"), protoreflect.ValueOfBytes(value))
+			items.Append(item)
+		}
+	case "memcache.Delete":
+		items := field(req, "item").List()
+		statuses := mutable(res, "delete_status").List()
+		for i := 0; i < items.Len(); i++ {
+			key := string(field(items.Get(i).Message(), "key").Bytes())
+			if _, ok := f.memcache[key]; !ok {
+				statuses.Append(protoreflect.ValueOfEnum(2)) // NOT_FOUND
+				continue
+			}
+			delete(f.memcache, key)
+			statuses.Append(protoreflect.ValueOfEnum(1)) // DELETED
+		}
+	default:
+		return fmt.Errorf("fake AppEngine: %v.%v not implemented", service, method)
+	}
+	return nil
+}
+
+// fetch makes a URL Fetch request with net/http, verifying the server
+// certificate unless allowed not to, and never following redirects since
+// the urlfetch package leaves it to the client.
+func fetch(req, res protoreflect.Message) error {
+	methods := fieldDesc(req, "Method").Enum().Values()
+	method := string(methods.ByNumber(field(req, "Method").Enum()).Name())
+	r, err := http.NewRequest(method, field(req, "Url").String(), bytes.NewReader(field(req, "Payload").Bytes()))
+	if err != nil {
+		return err
+	}
+	headers := field(req, "header").List()
+	for i := 0; i < headers.Len(); i++ {
+		h := headers.Get(i).Message()
+		r.Header.Add(field(h, "Key").String(), field(h, "Value").String())
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: !field(req, "MustValidateServerCertificate").Bool()},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	resp, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	res.Set(fieldDesc(res, "Content"), protoreflect.ValueOfBytes(content))
+	res.Set(fieldDesc(res, "StatusCode"), protoreflect.ValueOfInt32(int32(resp.StatusCode)))
+	headers = mutable(res, "header").List()
+	for k, vs := range resp.Header {
+		for _, v := range vs {
+			h := headers.NewElement()
+			h.Message().Set(fieldDesc(h.Message(), "Key"), protoreflect.ValueOfString(k))
+			h.Message().Set(fieldDesc(h.Message(), "Value"), protoreflect.ValueOfString(v))
+			headers.Append(h)
+		}
+	}
+	return nil
+}
+
+// count returns the number of Datastore entities of a kind.
+func (f *fakeAppEngine) count(kind string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, k := range f.kinds {
+		if k == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// fieldDesc returns the descriptor of a field of a message by name.
+func fieldDesc(m protoreflect.Message, name string) protoreflect.FieldDescriptor {
+	return m.Descriptor().Fields().ByName(protoreflect.Name(name))
+}
+
+// field returns the value of a field of a message by name.
+func field(m protoreflect.Message, name string) protoreflect.Value {
+	return m.Get(fieldDesc(m, name))
+}
+
+// mutable returns the mutable value of a field of a message by name.
+func mutable(m protoreflect.Message, name string) protoreflect.Value {
+	return m.Mutable(fieldDesc(m, name))
+}
+
+// marshal returns a message marshaled, to use as a map key.
+func marshal(m protoreflect.Message) string {
+	b, err := proto.Marshal(proto.MessageV1(m.Interface()))
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
@@ -0,0 +1,57 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2/google"
+	storage "google.golang.org/api/storage/v1"
+	"google.golang.org/appengine/log"
+)
+
+// backupBucket is the Cloud Storage bucket issued certificates and keys are
+// backed up to, set with the AELE_BACKUP_BUCKET environment variable.
+var backupBucket = os.Getenv("AELE_BACKUP_BUCKET")
+
+// backupCertOnly is whether only certificates are backed up, not their
+// private keys, set with the AELE_BACKUP_CERT_ONLY=1 environment variable.
+var backupCertOnly = os.Getenv("AELE_BACKUP_CERT_ONLY") == "1"
+
+// backup saves an issued certificate and its key to the backup bucket if
+// configured, as <domain>/<issue time>/cert.pem and key.pem.
+// It uses the Cloud Storage API as the AppEngine default service account.
+// The certificate is already in use, so failures are only logged.
+func backup(ctx context.Context, domain, cert, key string) {
+	if backupBucket == "" {
+		return
+	}
+	if err := backupObjects(ctx, domain, cert, key); err != nil {
+		log.Errorf(ctx, "domain=%v: backup to %v: %v", domain, backupBucket, err)
+	}
+}
+
+func backupObjects(ctx context.Context, domain, cert, key string) error {
+	client, err := google.DefaultClient(ctx, storage.DevstorageReadWriteScope)
+	if err != nil {
+		return fmt.Errorf("default client: %v", err)
+	}
+	svc, err := storage.New(client)
+	if err != nil {
+		return fmt.Errorf("storage client: %v", err)
+	}
+	prefix := strings.TrimPrefix(domain, "*.") + "/" + time.Now().UTC().Format("20060102T150405Z") + "/"
+	objects := map[string]string{"cert.pem": cert}
+	if !backupCertOnly {
+		objects["key.pem"] = key
+	}
+	for name, content := range objects {
+		object := &storage.Object{Name: prefix + name, ContentType: "application/x-pem-file"}
+		if _, err := svc.Objects.Insert(backupBucket, object).Media(strings.NewReader(content)).Do(); err != nil {
+			return fmt.Errorf("insert %v: %v", object.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package aeletsencrypt
+
+import (
+	"fmt"
+	"time"
+)
+
+// weeklyBudget is the maximum number of certificates ordered for all domains
+// in a rolling week, so that large fleets stay within CA rate limits such as
+// the number of new orders per account. It defaults to 0 for no maximum and
+// is configurable with the AELE_WEEKLY_BUDGET environment variable, from 0 to
+// 10000.
+var weeklyBudget = envInt("AELE_WEEKLY_BUDGET", 0, 0, 10000)
+
+// maxIssuances is the maximum number of certificates created or updated per
+// run, across all apps, the others being deferred to the next run. It defaults
+// to 0 for no maximum and is configurable with the AELE_MAX_ISSUANCES
+// environment variable, from 0 to 1000.
+var maxIssuances = envInt("AELE_MAX_ISSUANCES", 0, 0, 1000)
+
+// budgetName is the name of the issued entity counting certificates towards
+// weeklyBudget. It cannot be a registered domain.
+const budgetName = "*budget*"
+
+// budgetError is the error of a certificate not ordered because weeklyBudget
+// is spent.
+type budgetError struct {
+	until time.Time
+}
+
+func (e *budgetError) Error() string {
+	return fmt.Sprintf("weekly budget of %v certificates spent, deferred until %v (in %v)",
+		weeklyBudget, e.until.UTC().Format(time.RFC3339), time.Until(e.until).Round(time.Minute))
+}
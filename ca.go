@@ -0,0 +1,58 @@
+package aeletsencrypt
+
+import (
+	"net/url"
+	"os"
+
+	"golang.org/x/crypto/acme"
+)
+
+// ca is an ACME CA to order certificates from.
+type ca struct {
+	directory string // directory URL
+	envPrefix string // of its External Account Binding environment variables
+}
+
+// fallbackDirectory is the directory URL of a CA to order certificates from
+// when the primary one (see directoryURL) is rate limiting or unavailable,
+// read from the AELE_ACME_FALLBACK_DIRECTORY environment variable. Its
+// External Account Binding is read from AELE_FALLBACK_EAB_KID and
+// AELE_FALLBACK_EAB_HMAC_KEY.
+var fallbackDirectory = os.Getenv("AELE_ACME_FALLBACK_DIRECTORY")
+
+// cas returns the CAs to order certificates from, in order.
+func cas() []ca {
+	list := []ca{{directoryURL(), "AELE_"}}
+	if fallbackDirectory != "" {
+		list = append(list, ca{fallbackDirectory, "AELE_FALLBACK_"})
+	}
+	return list
+}
+
+// unavailableError is an error ordering a certificate from a CA which is
+// rate limiting or unavailable, so another one can be tried.
+type unavailableError struct {
+	err error
+}
+
+func (e *unavailableError) Error() string {
+	return e.err.Error()
+}
+
+// unavailable marks err as unavailableError if its cause is that the CA is
+// rate limiting, fails with a server error, or cannot be reached.
+func unavailable(err, cause error) error {
+	if _, ok := acme.RateLimit(cause); ok {
+		return &unavailableError{err}
+	}
+	if e, ok := cause.(*acme.Error); ok {
+		if e.StatusCode >= 500 {
+			return &unavailableError{err}
+		}
+		return err
+	}
+	if _, ok := cause.(*url.Error); ok {
+		return &unavailableError{err}
+	}
+	return err
+}
@@ -0,0 +1,521 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// testCA is a mock ACME CA (RFC 8555) for tests, issuing certificates with
+// its own intermediate and root. It does not verify request signatures, and
+// validates http-01 challenges from the challenge store, as the challenge
+// handler would serve them.
+type testCA struct {
+	srv *httptest.Server
+
+	// rateLimited makes new orders fail with a rate limit error.
+	rateLimited bool
+	// fetch returns the response served at an http-01 challenge path of a
+	// domain.
+	fetch func(domain, path string) (string, error)
+	// records are the TXT records of dns-01 challenges, by fully qualified
+	// name, updated with updateRecord.
+	records map[string][]string
+
+	mu       sync.Mutex
+	accounts map[string]crypto.PublicKey // by account URL
+	orders   map[string]*testOrder       // by URL
+	authzs   map[string]*testAuthz       // by URL
+	certs    map[string]string           // PEM chain by URL
+	csrs     []*x509.CertificateRequest  // finalized, in order
+	accepted []string                    // challenge type and domain, in order
+	lastID   int
+
+	root, intermediate       *x509.Certificate
+	rootKey, intermediateKey crypto.Signer
+}
+
+type testOrder struct {
+	Status         string         `json:"status"`
+	Identifiers    []acme.AuthzID `json:"identifiers"`
+	Authorizations []string       `json:"authorizations"`
+	Finalize       string         `json:"finalize"`
+	Certificate    string         `json:"certificate,omitempty"`
+	authzs         []*testAuthz
+}
+
+type testAuthz struct {
+	Identifier acme.AuthzID     `json:"identifier"`
+	Status     string           `json:"status"`
+	Expires    time.Time        `json:"expires"`
+	Wildcard   bool             `json:"wildcard,omitempty"`
+	Challenges []*testChallenge `json:"challenges"`
+	account    string
+}
+
+type testChallenge struct {
+	Type   string       `json:"type"`
+	URL    string       `json:"url"`
+	Token  string       `json:"token"`
+	Status string       `json:"status"`
+	Error  *testProblem `json:"error,omitempty"`
+	authz  *testAuthz
+}
+
+type testProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status,omitempty"`
+}
+
+// newTestCA starts a mock CA and has the package use it, validating
+// challenges saved with a test context.
+func newTestCA(t *testing.T, ctx context.Context) *testCA {
+	ca := &testCA{
+		fetch:    func(domain, path string) (string, error) { return getChallenge(ctx, path) },
+		accounts: map[string]crypto.PublicKey{},
+		orders:   map[string]*testOrder{},
+		authzs:   map[string]*testAuthz{},
+		certs:    map[string]string{},
+		records:  map[string][]string{},
+	}
+	ca.rootKey, ca.root = testIssuer(t, "Test Root", nil, nil, 10*365*24*time.Hour)
+	ca.intermediateKey, ca.intermediate = testIssuer(t, "Test Intermediate", ca.root, ca.rootKey, 5*365*24*time.Hour)
+	ca.srv = httptest.NewServer(http.HandlerFunc(ca.serve))
+	t.Cleanup(ca.srv.Close)
+
+	t.Setenv("AELE_ACME_DIRECTORY", ca.srv.URL+"/directory")
+	restore := acmeHTTPClient
+	acmeHTTPClient = func(context.Context) *http.Client { return ca.srv.Client() }
+	restoreRecord := updateRecord
+	updateRecord = ca.updateRecord
+	skip := skipPreflight
+	skipPreflight = true
+	t.Cleanup(func() {
+		acmeHTTPClient = restore
+		updateRecord = restoreRecord
+		skipPreflight = skip
+	})
+	return ca
+}
+
+// testIssuer creates an issuer certificate, self-signed without a parent.
+func testIssuer(t *testing.T, name string, parent *x509.Certificate, parentKey crypto.Signer, validity time.Duration) (crypto.Signer, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, cert
+}
+
+// url returns the URL of a path of the CA.
+func (ca *testCA) url(path string) string {
+	return ca.srv.URL + path
+}
+
+// newURL returns a new URL of a resource of the CA.
+func (ca *testCA) newURL(resource string) string {
+	ca.lastID++
+	return ca.url(fmt.Sprintf("/%v/%v", resource, ca.lastID))
+}
+
+func (ca *testCA) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%v", time.Now().UnixNano()))
+	switch {
+	case r.URL.Path == "/directory":
+		ca.reply(w, http.StatusOK, map[string]interface{}{
+			"newNonce":   ca.url("/nonce"),
+			"newAccount": ca.url("/account"),
+			"newOrder":   ca.url("/order"),
+			"revokeCert": ca.url("/revoke"),
+			"keyChange":  ca.url("/key-change"),
+			"meta": map[string]interface{}{
+				"profiles": map[string]string{
+					"classic":    "90 days",
+					"shortlived": "6 days",
+				},
+			},
+		})
+		return
+	case r.URL.Path == "/nonce":
+		return
+	}
+
+	var jws struct {
+		Protected, Payload string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		ca.problem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	var protected struct {
+		JWK json.RawMessage
+		KID string
+	}
+	if err := decodeB64JSON(jws.Protected, &protected); err != nil {
+		ca.problem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		ca.problem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	url := ca.url(r.URL.Path)
+	if r.URL.Path == "/account" {
+		ca.account(w, protected.JWK, payload)
+		return
+	}
+	if _, ok := ca.accounts[protected.KID]; !ok {
+		ca.problem(w, http.StatusUnauthorized, "accountDoesNotExist", "no account "+protected.KID)
+		return
+	}
+	switch {
+	case r.URL.Path == "/order":
+		ca.newOrder(w, protected.KID, payload)
+	case ca.orders[url] != nil:
+		ca.reply(w, http.StatusOK, ca.orders[url])
+	case ca.authzs[url] != nil:
+		ca.reply(w, http.StatusOK, ca.authzs[url])
+	case strings.HasPrefix(r.URL.Path, "/challenge/"):
+		ca.challenge(w, ca.accounts[protected.KID], url)
+	case strings.HasPrefix(r.URL.Path, "/finalize/"):
+		ca.finalize(w, ca.orders[strings.Replace(url, "/finalize/", "/order/", 1)], payload)
+	case ca.certs[url] != "":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		fmt.Fprint(w, ca.certs[url])
+	default:
+		ca.problem(w, http.StatusNotFound, "malformed", "not found")
+	}
+}
+
+// account registers an account, or returns the existing one of a key.
+func (ca *testCA) account(w http.ResponseWriter, jwk json.RawMessage, payload []byte) {
+	key, err := parseTestJWK(jwk)
+	if err != nil {
+		ca.problem(w, http.StatusBadRequest, "badPublicKey", err.Error())
+		return
+	}
+	thumbprint, err := acme.JWKThumbprint(key)
+	if err != nil {
+		ca.problem(w, http.StatusBadRequest, "badPublicKey", err.Error())
+		return
+	}
+	var req struct {
+		OnlyReturnExisting bool
+	}
+	json.Unmarshal(payload, &req)
+	for url, k := range ca.accounts {
+		if t, _ := acme.JWKThumbprint(k); t == thumbprint {
+			w.Header().Set("Location", url)
+			ca.reply(w, http.StatusOK, map[string]string{"status": acme.StatusValid})
+			return
+		}
+	}
+	if req.OnlyReturnExisting {
+		ca.problem(w, http.StatusBadRequest, "accountDoesNotExist", "no account for key")
+		return
+	}
+	url := ca.newURL("account")
+	ca.accounts[url] = key
+	w.Header().Set("Location", url)
+	ca.reply(w, http.StatusCreated, map[string]string{"status": acme.StatusValid})
+}
+
+// newOrder creates an order of an account with an authorization per
+// identifier, reusing valid authorizations of the account like CAs do.
+func (ca *testCA) newOrder(w http.ResponseWriter, account string, payload []byte) {
+	if ca.rateLimited {
+		w.Header().Set("Retry-After", "3600")
+		ca.problem(w, http.StatusTooManyRequests, "rateLimited", "too many certificates already issued")
+		return
+	}
+	var req struct {
+		Identifiers []acme.AuthzID
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		ca.problem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	url := ca.newURL("order")
+	o := &testOrder{
+		Status:      acme.StatusPending,
+		Identifiers: req.Identifiers,
+		Finalize:    strings.Replace(url, "/order/", "/finalize/", 1),
+	}
+	for _, id := range req.Identifiers {
+		a := &testAuthz{
+			Identifier: acme.AuthzID{Type: id.Type, Value: strings.TrimPrefix(id.Value, "*.")},
+			Status:     acme.StatusPending,
+			Expires:    time.Now().Add(7 * 24 * time.Hour),
+			Wildcard:   strings.HasPrefix(id.Value, "*."),
+			account:    account,
+		}
+		if authzURL, valid := ca.validAuthz(a); valid != nil {
+			o.Authorizations = append(o.Authorizations, authzURL)
+			o.authzs = append(o.authzs, valid)
+			continue
+		}
+		types := []string{"http-01", "dns-01", "tls-alpn-01"}
+		if a.Wildcard {
+			types = []string{"dns-01"}
+		}
+		for _, t := range types {
+			c := &testChallenge{Type: t, URL: ca.newURL("challenge"), Status: acme.StatusPending, authz: a}
+			c.Token = strings.TrimPrefix(c.URL, ca.url("/challenge/")) + "-token"
+			a.Challenges = append(a.Challenges, c)
+		}
+		authzURL := ca.newURL("authz")
+		ca.authzs[authzURL] = a
+		o.Authorizations = append(o.Authorizations, authzURL)
+		o.authzs = append(o.authzs, a)
+	}
+	o.update()
+	ca.orders[url] = o
+	w.Header().Set("Location", url)
+	ca.reply(w, http.StatusCreated, o)
+}
+
+// validAuthz returns a valid authorization of the same account and
+// identifier as a new one, with its URL, or nil if there is none.
+func (ca *testCA) validAuthz(a *testAuthz) (string, *testAuthz) {
+	for url, v := range ca.authzs {
+		if v.Status == acme.StatusValid && v.account == a.account && v.Identifier == a.Identifier && v.Wildcard == a.Wildcard {
+			return url, v
+		}
+	}
+	return "", nil
+}
+
+// challenge validates a challenge the client accepted, then its
+// authorization and order.
+func (ca *testCA) challenge(w http.ResponseWriter, key crypto.PublicKey, url string) {
+	var c *testChallenge
+	for _, a := range ca.authzs {
+		for _, ch := range a.Challenges {
+			if ch.URL == url {
+				c = ch
+			}
+		}
+	}
+	if c == nil {
+		ca.problem(w, http.StatusNotFound, "malformed", "no challenge "+url)
+		return
+	}
+	if c.Status == acme.StatusPending {
+		ca.accepted = append(ca.accepted, c.Type+" "+c.authz.Identifier.Value)
+		c.Status, c.authz.Status = acme.StatusValid, acme.StatusValid
+		if err := ca.validate(c, key); err != nil {
+			c.Status, c.authz.Status = acme.StatusInvalid, acme.StatusInvalid
+			c.Error = &testProblem{Type: "urn:ietf:params:acme:error:unauthorized", Detail: err.Error(), Status: http.StatusForbidden}
+		}
+		for _, o := range ca.orders {
+			o.update()
+		}
+	}
+	ca.reply(w, http.StatusOK, c)
+}
+
+// validate checks the response to a challenge.
+func (ca *testCA) validate(c *testChallenge, key crypto.PublicKey) error {
+	thumbprint, err := acme.JWKThumbprint(key)
+	if err != nil {
+		return err
+	}
+	keyAuth := c.Token + "." + thumbprint
+	domain := c.authz.Identifier.Value
+	switch c.Type {
+	case "http-01":
+		path := challengePath + c.Token
+		got, err := ca.fetch(domain, path)
+		if err != nil {
+			return fmt.Errorf("invalid response from http://%v%v: %v", domain, path, err)
+		}
+		if got != keyAuth {
+			return fmt.Errorf("invalid response from http://%v%v: %q", domain, path, got)
+		}
+		return nil
+	case "dns-01":
+		name := "_acme-challenge." + domain + "."
+		sum := sha256.Sum256([]byte(keyAuth))
+		want := base64.RawURLEncoding.EncodeToString(sum[:])
+		for _, v := range ca.records[name] {
+			if v == want {
+				return nil
+			}
+		}
+		return fmt.Errorf("no TXT record %q for %v", want, name)
+	}
+	return fmt.Errorf("%v not supported by the test CA", c.Type)
+}
+
+// updateRecord adds or removes a TXT record value, see updateTXT.
+func (ca *testCA) updateRecord(ctx context.Context, name, value string, add bool) error {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	values := ca.records[name]
+	if add {
+		ca.records[name] = append(values, value)
+		return nil
+	}
+	for i, v := range values {
+		if v == value {
+			ca.records[name] = append(values[:i:i], values[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// update sets the status of an order from its authorizations.
+func (o *testOrder) update() {
+	if o.Status != acme.StatusPending {
+		return
+	}
+	ready := true
+	for _, a := range o.authzs {
+		switch a.Status {
+		case acme.StatusInvalid:
+			o.Status = acme.StatusInvalid
+			return
+		case acme.StatusValid:
+		default:
+			ready = false
+		}
+	}
+	if ready {
+		o.Status = acme.StatusReady
+	}
+}
+
+// finalize issues the certificate of a ready order.
+func (ca *testCA) finalize(w http.ResponseWriter, o *testOrder, payload []byte) {
+	if o == nil || o.Status != acme.StatusReady {
+		ca.problem(w, http.StatusForbidden, "orderNotReady", "order not ready")
+		return
+	}
+	var req struct {
+		CSR string
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		ca.problem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	der, err := base64.RawURLEncoding.DecodeString(req.CSR)
+	if err != nil {
+		ca.problem(w, http.StatusBadRequest, "badCSR", err.Error())
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		ca.problem(w, http.StatusBadRequest, "badCSR", err.Error())
+		return
+	}
+	ca.csrs = append(ca.csrs, csr)
+	cert, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: csr.Subject.CommonName},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca.intermediate, csr.PublicKey, ca.intermediateKey)
+	if err != nil {
+		ca.problem(w, http.StatusInternalServerError, "serverInternal", err.Error())
+		return
+	}
+	var chain []byte
+	for _, b := range [][]byte{cert, ca.intermediate.Raw} {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b})...)
+	}
+	o.Certificate = ca.newURL("cert")
+	o.Status = acme.StatusValid
+	ca.certs[o.Certificate] = string(chain)
+	ca.reply(w, http.StatusOK, o)
+}
+
+func (ca *testCA) reply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (ca *testCA) problem(w http.ResponseWriter, status int, typ, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(testProblem{Type: "urn:ietf:params:acme:error:" + typ, Detail: detail, Status: status})
+}
+
+// decodeB64JSON decodes base64url encoded JSON.
+func decodeB64JSON(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// parseTestJWK parses an RSA public key in JWK form, the account key type.
+func parseTestJWK(b []byte) (crypto.PublicKey, error) {
+	var jwk struct {
+		Kty, N, E string
+	}
+	if err := json.Unmarshal(b, &jwk); err != nil {
+		return nil, err
+	}
+	if jwk.Kty != "RSA" {
+		return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+	n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+	if err != nil {
+		return nil, err
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+}
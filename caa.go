@@ -0,0 +1,135 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+)
+
+// checkCAA is whether CAA records of domains are checked to authorize the CA
+// before ordering, set with the AELE_CHECK_CAA=1 environment variable.
+var checkCAA = os.Getenv("AELE_CHECK_CAA") == "1"
+
+// caaType is the DNS resource record type of CAA.
+const caaType = 257
+
+// caaIdentity returns the issuer domain name of the CA in CAA records:
+// the AELE_CAA_IDENTITY environment variable, or else known for Let's Encrypt
+// and Google Public CA, or else "" if unknown.
+func caaIdentity() string {
+	if id := os.Getenv("AELE_CAA_IDENTITY"); id != "" {
+		return id
+	}
+	switch directoryURL() {
+	case acme.LetsEncryptURL, stagingURL:
+		return "letsencrypt.org"
+	case googleURL, googleStagingURL:
+		return "pki.goog"
+	}
+	return ""
+}
+
+// caa checks that CAA records (RFC 8659) of the domains, if any, authorize
+// the CA to issue for them, looking up the closest records of each domain or
+// its parents. It uses Google Public DNS over HTTPS as CAA records cannot be
+// resolved with the net package.
+func caa(ctx context.Context, domains []string) error {
+	if !checkCAA {
+		return nil
+	}
+	identity := caaIdentity()
+	if identity == "" {
+		return fmt.Errorf("caa: unknown CA identity, set AELE_CAA_IDENTITY")
+	}
+	for _, domain := range domains {
+		wildcard := strings.HasPrefix(domain, "*.")
+		name, err := asciiDomain(strings.TrimPrefix(domain, "*."))
+		if err != nil {
+			return err
+		}
+		for ; strings.Contains(name, "."); name = name[strings.Index(name, ".")+1:] {
+			records, err := lookupCAA(ctx, name)
+			if err != nil {
+				return fmt.Errorf("caa: %v", err)
+			}
+			if len(records) == 0 {
+				continue
+			}
+			if !caaAuthorized(records, identity, wildcard) {
+				return fmt.Errorf("caa: %v does not authorize %v to issue for %v: %v",
+					name, identity, domain, strings.Join(records, "; "))
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// caaAuthorized returns whether CAA records authorize a CA identity to issue,
+// for a wildcard or not.
+func caaAuthorized(records []string, identity string, wildcard bool) bool {
+	tags := map[string][]string{} // tag to issuer domain names
+	for _, r := range records {
+		// flags tag "value", where value is the issuer domain and parameters.
+		fields := strings.SplitN(r, " ", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		tag := strings.ToLower(fields[1])
+		issuer := strings.TrimSpace(strings.SplitN(strings.Trim(fields[2], `"`), ";", 2)[0])
+		tags[tag] = append(tags[tag], issuer)
+	}
+	issuers, ok := tags["issuewild"]
+	if !wildcard || !ok {
+		issuers, ok = tags["issue"]
+	}
+	if !ok {
+		return true
+	}
+	for _, issuer := range issuers {
+		if strings.EqualFold(issuer, identity) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupCAA returns the CAA records of a name.
+func lookupCAA(ctx context.Context, name string) ([]string, error) {
+	u := "https://dns.google/resolve?type=CAA&name=" + url.QueryEscape(name)
+	res, err := httpClient(ctx).Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("lookup %v: %v", name, res.Status)
+	}
+	var reply struct {
+		Status int
+		Answer []struct {
+			Type int    `json:"type"`
+			Data string `json:"data"`
+		}
+	}
+	if err := json.NewDecoder(res.Body).Decode(&reply); err != nil {
+		return nil, fmt.Errorf("lookup %v: %v", name, err)
+	}
+	// NOERROR or NXDOMAIN, the latter having no records.
+	if reply.Status != 0 && reply.Status != 3 {
+		return nil, fmt.Errorf("lookup %v: DNS status %v", name, reply.Status)
+	}
+	var records []string
+	for _, a := range reply.Answer {
+		if a.Type == caaType {
+			records = append(records, a.Data)
+		}
+	}
+	return records, nil
+}
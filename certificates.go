@@ -0,0 +1,73 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/user"
+)
+
+// certificatesHandler lists the certificate bound to each custom domain.
+func certificatesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	if !user.IsAdmin(ctx) {
+		http.Error(w, "unauthorized", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	if err := listCertificates(ctx, w); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+	}
+}
+
+// listCertificates writes, for each custom domain of this app and extra
+// apps, the SHA-256 fingerprint, issuer and validity of the leaf of the
+// certificate bound to it, so that operators can verify which certificate
+// is served and detect unexpected changes.
+func listCertificates(ctx context.Context, w io.Writer) error {
+	svc, err := newAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	for _, appID := range append([]string{appengine.AppID(ctx)}, extraApps...) {
+		if len(extraApps) > 0 {
+			fmt.Fprintf(w, "App %v:\n", appID)
+		}
+		mappings, err := svc.ListDomainMappings(appID)
+		if err != nil {
+			return addTip(ctx, classify(fmt.Errorf("list domains: %v", err), err))
+		}
+		certs, err := svc.ListCertificates(appID)
+		if err != nil {
+			return addTip(ctx, classify(fmt.Errorf("list certs: %v", err), err))
+		}
+		chains := map[string]string{}
+		for _, c := range certs {
+			if c.CertificateRawData != nil {
+				chains[c.Id] = c.CertificateRawData.PublicCertificate
+			}
+		}
+		for _, m := range mappings {
+			if m.SslSettings == nil || m.SslSettings.CertificateId == "" {
+				fmt.Fprintf(w, " - %v: no certificate\n", m.Id)
+				continue
+			}
+			id := m.SslSettings.CertificateId
+			chain, err := parseChain(chains[id])
+			if err != nil {
+				fmt.Fprintf(w, " - %v: certificate %v, %v\n", m.Id, id, err)
+				continue
+			}
+			leaf := chainPath(chain)[0]
+			fmt.Fprintf(w, " - %v: certificate %v, SHA-256 %x, issued by %v, valid from %v to %v\n",
+				m.Id, id, sha256.Sum256(leaf.Raw), leaf.Issuer.CommonName,
+				leaf.NotBefore.UTC().Format(time.RFC3339), leaf.NotAfter.UTC().Format(time.RFC3339))
+		}
+	}
+	return nil
+}
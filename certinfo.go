@@ -0,0 +1,165 @@
+package aeletsencrypt
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	api "google.golang.org/api/appengine/v1beta"
+)
+
+// parseChain parses the PEM encoded certificates of a chain, leaf first.
+func parseChain(data string) ([]*x509.Certificate, error) {
+	var chain []*x509.Certificate
+	rest := []byte(data)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no certificate")
+	}
+	return chain, nil
+}
+
+// leafExpiry is whether certificate expiry is read from the leaf of their
+// public certificate rather than trusting the Admin API expiry, set with the
+// AELE_LEAF_EXPIRY=1 environment variable.
+var leafExpiry = os.Getenv("AELE_LEAF_EXPIRY") == "1"
+
+// certExpiry returns when an uploaded certificate expires: the Admin API
+// expiry, or with leafExpiry the leaf NotAfter if its public certificate is
+// available.
+func certExpiry(c *api.AuthorizedCertificate) (time.Time, error) {
+	if leafExpiry && c.CertificateRawData != nil && c.CertificateRawData.PublicCertificate != "" {
+		if chain, err := parseChain(c.CertificateRawData.PublicCertificate); err == nil {
+			return chainPath(chain)[0].NotAfter, nil
+		}
+	}
+	return time.Parse(time.RFC3339, c.ExpireTime)
+}
+
+// certDetails describes the leaf of an uploaded certificate: its serial
+// number, issuer and key, if its public certificate is available.
+func certDetails(c *api.AuthorizedCertificate) string {
+	if c.CertificateRawData == nil || c.CertificateRawData.PublicCertificate == "" {
+		return "no details"
+	}
+	chain, err := parseChain(c.CertificateRawData.PublicCertificate)
+	if err != nil {
+		return fmt.Sprintf("invalid certificate: %v", err)
+	}
+	leaf := chainPath(chain)[0]
+	return fmt.Sprintf("serial %x, issued by %v, %v key, chain %v",
+		leaf.SerialNumber, leaf.Issuer.CommonName, keyType(leaf), chainNames(chain))
+}
+
+// chainPath returns the certificates of a chain from its leaf up to the
+// last one present, following issuers, as uploaded chains may be out of
+// order or contain unrelated certificates. The leaf is the certificate
+// issuing none of the others.
+func chainPath(certs []*x509.Certificate) []*x509.Certificate {
+	issuers := map[string]bool{}
+	for _, c := range certs {
+		if !bytes.Equal(c.RawIssuer, c.RawSubject) {
+			issuers[string(c.RawIssuer)] = true
+		}
+	}
+	path := []*x509.Certificate{certs[0]}
+	for _, c := range certs {
+		if !issuers[string(c.RawSubject)] {
+			path[0] = c
+			break
+		}
+	}
+	for len(path) < len(certs) {
+		last := path[len(path)-1]
+		if bytes.Equal(last.RawIssuer, last.RawSubject) {
+			break // self-signed root
+		}
+		var next *x509.Certificate
+		for _, c := range certs {
+			if c != last && bytes.Equal(c.RawSubject, last.RawIssuer) {
+				next = c
+				break
+			}
+		}
+		if next == nil {
+			break
+		}
+		path = append(path, next)
+	}
+	return path
+}
+
+// chainNames describes a chain by the subject names of its certificates from
+// the leaf up, ending with the root, which chains usually omit, e.g.
+// "www.example.com -> R3 -> ISRG Root X1", to tell which intermediate is used.
+func chainNames(certs []*x509.Certificate) string {
+	var names []string
+	path := chainPath(certs)
+	for _, c := range path {
+		names = append(names, subjectName(c.Subject))
+	}
+	if last := path[len(path)-1]; !bytes.Equal(last.RawIssuer, last.RawSubject) {
+		names = append(names, subjectName(last.Issuer))
+	}
+	return strings.Join(names, " -> ")
+}
+
+// subjectName returns the common name of a subject, or the whole subject if
+// it has none.
+func subjectName(name pkix.Name) string {
+	if name.CommonName != "" {
+		return name.CommonName
+	}
+	return name.String()
+}
+
+// certChain describes the chain of a PEM encoded certificate, "" if invalid.
+func certChain(cert string) string {
+	chain, err := parseChain(cert)
+	if err != nil {
+		return ""
+	}
+	return chainNames(chain)
+}
+
+// keyType describes the public key type and size of a certificate.
+func keyType(cert *x509.Certificate) string {
+	switch k := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %v", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		return fmt.Sprintf("ECDSA %v", k.Curve.Params().Name)
+	}
+	return cert.PublicKeyAlgorithm.String()
+}
+
+// notAfter returns the expiry of the leaf of a PEM encoded chain, or the zero
+// time if invalid.
+func notAfter(cert string) time.Time {
+	chain, err := parseChain(cert)
+	if err != nil {
+		return time.Time{}
+	}
+	return chainPath(chain)[0].NotAfter
+}
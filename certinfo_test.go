@@ -0,0 +1,66 @@
+package aeletsencrypt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	api "google.golang.org/api/appengine/v1beta"
+)
+
+func TestCertExpiry(t *testing.T) {
+	// The intermediate expires before the leaf and is uploaded first, and the
+	// Admin API expiry reflects it rather than the leaf.
+	rootKey, root := testIssuer(t, "Test Root", nil, nil, 365*24*time.Hour)
+	intermediateKey, intermediate := testIssuer(t, "Test Intermediate", root, rootKey, 20*24*time.Hour)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafNotAfter := time.Now().Add(60 * 24 * time.Hour).Truncate(time.Second)
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     leafNotAfter,
+	}, intermediate, key.Public(), intermediateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: intermediate.Raw})) +
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	apiExpiry := intermediate.NotAfter.UTC()
+	c := &api.AuthorizedCertificate{
+		ExpireTime:         apiExpiry.Format(time.RFC3339),
+		CertificateRawData: &api.CertificateRawData{PublicCertificate: chain},
+	}
+
+	for _, tt := range []struct {
+		leafExpiry bool
+		want       time.Time
+	}{
+		{false, apiExpiry},
+		{true, leafNotAfter},
+	} {
+		restore := leafExpiry
+		leafExpiry = tt.leafExpiry
+		got, err := certExpiry(c)
+		leafExpiry = restore
+		if err != nil {
+			t.Fatalf("certExpiry(leafExpiry=%v): %v", tt.leafExpiry, err)
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("certExpiry(leafExpiry=%v): got %v, want %v", tt.leafExpiry, got, tt.want)
+		}
+	}
+	if got := notAfter(chain); !got.Equal(leafNotAfter) {
+		t.Errorf("notAfter: got %v, want %v", got, leafNotAfter)
+	}
+}
@@ -0,0 +1,64 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	api "google.golang.org/api/appengine/v1beta"
+	"google.golang.org/appengine/log"
+)
+
+// freeCertSlots is whether, when AppEngine refuses to upload a certificate
+// because the app reached its maximum number of certificates, the oldest
+// expired certificate not mapped to any domain is deleted to retry once,
+// set with the AELE_FREE_CERT_SLOTS=1 environment variable.
+var freeCertSlots = os.Getenv("AELE_FREE_CERT_SLOTS") == "1"
+
+// certLimitReached returns whether an upload failed because the app reached
+// its maximum number of certificates, rather than a CA rate limit.
+func certLimitReached(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return !strings.Contains(msg, "urn:ietf:params:acme") && strings.Contains(msg, "certificate") &&
+		(strings.Contains(msg, "limit") || strings.Contains(msg, "maximum number"))
+}
+
+// deleteExpiredOrphan deletes the certificate of an app expired the longest
+// ago among those uploaded by this package and not mapped to any domain,
+// returning whether there was one.
+func deleteExpiredOrphan(ctx context.Context, svc admin, appID string) (bool, error) {
+	mappings, err := svc.ListDomainMappings(appID)
+	if err != nil {
+		return false, fmt.Errorf("list domains: %v", err)
+	}
+	certs, err := svc.ListCertificates(appID)
+	if err != nil {
+		return false, fmt.Errorf("list certificates: %v", err)
+	}
+	bound, _ := boundCerts(mappings, certs)
+	var oldest *api.AuthorizedCertificate
+	var oldestExpiry time.Time
+	for _, c := range certs {
+		if bound[c.Id] || c.ManagedCertificate != nil || !marked(c) {
+			continue
+		}
+		expire, err := certExpiry(c)
+		if err != nil || time.Now().Before(expire) {
+			continue
+		}
+		if oldest == nil || expire.Before(oldestExpiry) {
+			oldest, oldestExpiry = c, expire
+		}
+	}
+	if oldest == nil {
+		return false, nil
+	}
+	if err := svc.DeleteCertificate(appID, oldest.Id); err != nil {
+		return false, fmt.Errorf("delete cert %v: %v", oldest.Id, err)
+	}
+	log.Infof(ctx, "app=%v: certificate limit reached, deleted expired certificate %v for %v",
+		appID, oldest.Id, strings.Join(oldest.DomainNames, ", "))
+	return true, nil
+}
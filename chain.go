@@ -0,0 +1,76 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/acme"
+	"google.golang.org/appengine/log"
+)
+
+// preferredChain is the issuer common name of the top certificate of the
+// chain to use among those the CA offers (e.g. "ISRG Root X1" to avoid a
+// cross-signed root), read from the AELE_PREFERRED_CHAIN environment
+// variable. By default the CA default chain is used.
+var preferredChain = os.Getenv("AELE_PREFERRED_CHAIN")
+
+// leafOnly is whether only the leaf certificate is used, without its chain,
+// set with the AELE_LEAF_ONLY=1 environment variable.
+var leafOnly = os.Getenv("AELE_LEAF_ONLY") == "1"
+
+// selectChain returns the chain to use for a certificate, DER encoded, from
+// the default chain the CA returned and the alternate chains it offers at
+// its certificate URL, according to preferredChain and leafOnly.
+func selectChain(ctx context.Context, client *acme.Client, certURL string, chain [][]byte) ([][]byte, error) {
+	if preferredChain != "" && chainIssuer(chain) != preferredChain {
+		alternate, err := alternateChain(ctx, client, certURL)
+		if err != nil {
+			return nil, err
+		}
+		if alternate != nil {
+			chain = alternate
+		} else {
+			log.Warningf(ctx, "preferred chain %v not offered, using the default one", preferredChain)
+		}
+	}
+	if leafOnly {
+		chain = chain[:1]
+	}
+	return chain, nil
+}
+
+// alternateChain returns the alternate chain with preferredChain offered at
+// a certificate URL, or nil if there is none.
+func alternateChain(ctx context.Context, client *acme.Client, certURL string) ([][]byte, error) {
+	opCtx, cancel := operationContext(ctx)
+	urls, err := client.ListCertAlternates(opCtx, certURL)
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("list alternates: %v", err)
+	}
+	for _, url := range urls {
+		const bundle = true
+		opCtx, cancel := operationContext(ctx)
+		chain, err := client.FetchCert(opCtx, url, bundle)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("fetch alternate: %v", err)
+		}
+		if chainIssuer(chain) == preferredChain {
+			return chain, nil
+		}
+	}
+	return nil, nil
+}
+
+// chainIssuer returns the issuer common name of the top certificate of a
+// chain, DER encoded.
+func chainIssuer(chain [][]byte) string {
+	cert, err := x509.ParseCertificate(chain[len(chain)-1])
+	if err != nil {
+		return ""
+	}
+	return cert.Issuer.CommonName
+}
@@ -0,0 +1,97 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+// challengeKind is the Datastore kind of http-01 challenge responses.
+const challengeKind = "AELetsEncryptChallenge"
+
+// challengeTTL is how long challenge responses are served at most, in case
+// they are not deleted once their authorization completed. It defaults to 10
+// minutes and is configurable with the AELE_CHALLENGE_TTL_MINUTES environment
+// variable, from 2 to 1440 for slow CAs.
+var challengeTTL = time.Duration(envInt("AELE_CHALLENGE_TTL_MINUTES", 10, 2, 24*60)) * time.Minute
+
+// challengeResponse is the Datastore entity of an http-01 challenge response,
+// keyed by its path.
+type challengeResponse struct {
+	Response string    `datastore:",noindex"`
+	Expires  time.Time `datastore:",noindex"`
+}
+
+// putChallenge stores an http-01 challenge response for its path in memcache
+// for speed, and in Datastore to survive memcache eviction. Outside AppEngine
+// standard, where memcache is not available, it is only stored in Datastore,
+// so that any instance serves it.
+func putChallenge(ctx context.Context, path, response string) error {
+	if appengine.IsStandard() {
+		if err := memcache.Set(ctx, &memcache.Item{
+			Key:        path,
+			Value:      []byte(response),
+			Expiration: challengeTTL,
+		}); err != nil {
+			return fmt.Errorf("memcache set: %v", err)
+		}
+	}
+	k := datastore.NewKey(ctx, challengeKind, path, 0, nil)
+	if _, err := datastore.Put(ctx, k, &challengeResponse{
+		Response: response,
+		Expires:  time.Now().Add(challengeTTL),
+	}); err != nil {
+		return fmt.Errorf("datastore put: %v", err)
+	}
+	return nil
+}
+
+// getChallenge returns the http-01 challenge response for a path from
+// memcache, or from Datastore on memcache miss or outside AppEngine standard.
+// It returns memcache.ErrCacheMiss if there is none.
+func getChallenge(ctx context.Context, path string) (string, error) {
+	if appengine.IsStandard() {
+		item, err := memcache.Get(ctx, path)
+		switch err {
+		case nil:
+			return string(item.Value), nil
+		case memcache.ErrCacheMiss:
+		default:
+			return "", fmt.Errorf("memcache get: %v", err)
+		}
+	}
+
+	k := datastore.NewKey(ctx, challengeKind, path, 0, nil)
+	var c challengeResponse
+	switch err := datastore.Get(ctx, k, &c); err {
+	case nil:
+	case datastore.ErrNoSuchEntity:
+		return "", memcache.ErrCacheMiss
+	default:
+		return "", fmt.Errorf("datastore get: %v", err)
+	}
+	if time.Now().After(c.Expires) {
+		return "", memcache.ErrCacheMiss
+	}
+	return c.Response, nil
+}
+
+// deleteChallenge deletes the challenge response for a path once the
+// authorization completed, rather than serving it until it expires.
+// Failures are only logged.
+func deleteChallenge(ctx context.Context, path string) {
+	if appengine.IsStandard() {
+		if err := memcache.Delete(ctx, path); err != nil && err != memcache.ErrCacheMiss {
+			log.Warningf(ctx, "memcache delete %v: %v", path, err)
+		}
+	}
+	k := datastore.NewKey(ctx, challengeKind, path, 0, nil)
+	if err := datastore.Delete(ctx, k); err != nil {
+		log.Warningf(ctx, "datastore delete %v: %v", path, err)
+	}
+}
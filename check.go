@@ -0,0 +1,93 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/user"
+)
+
+// checkHandler verifies the setup without ordering any certificate.
+func checkHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	if !user.IsAdmin(ctx) {
+		http.Error(w, "unauthorized", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	if !check(ctx, w) {
+		fmt.Fprintln(w, "\nSome checks failed.")
+		return
+	}
+	fmt.Fprintln(w, "\nAll checks passed.")
+}
+
+// check verifies the setup: configuration, Admin API access and permissions,
+// and that the challenge handler serves challenges for each custom domain.
+// It writes a checklist and returns whether all checks passed.
+func check(ctx context.Context, w io.Writer) bool {
+	ok := true
+	result := func(err error, format string, args ...interface{}) {
+		if err != nil {
+			ok = false
+			fmt.Fprintf(w, "[FAIL] %v: %v\n", fmt.Sprintf(format, args...), err)
+			return
+		}
+		fmt.Fprintf(w, "[PASS] %v\n", fmt.Sprintf(format, args...))
+	}
+	appID := appengine.AppID(ctx)
+
+	result(configErr, "configuration")
+	svc, err := newAdmin(ctx)
+	result(err, "Admin API client")
+	if err != nil {
+		return false
+	}
+	mappings, err := svc.ListDomainMappings(appID)
+	result(addTipIfErr(ctx, err), "Admin API enabled, %v custom domains", len(mappings))
+	_, err = svc.ListCertificates(appID)
+	result(addTipIfErr(ctx, err), "service account can read certificates")
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		result(err, "challenge token")
+		return false
+	}
+	path := challengePath + "check-" + hex.EncodeToString(token)
+	response := "check"
+	err = putChallenge(ctx, path, response)
+	result(err, "challenge saved")
+	if err != nil {
+		return false
+	}
+	defer deleteChallenge(ctx, path)
+	for _, e := range mappings {
+		domain := e.Id
+		if reason := unmanaged(domain); reason != "" {
+			fmt.Fprintf(w, "[SKIP] %v: %v\n", domain, reason)
+			continue
+		}
+		result(fetchChallenge(ctx, domain, path, response), "%v serves challenges", domain)
+		if challengeService != "" {
+			service, err := challengeRoute(ctx, domain)
+			if err == nil && service != challengeService {
+				err = fmt.Errorf("routed to service %v, check dispatch.yaml", service)
+			}
+			result(err, "%v routes challenges to service %v", domain, challengeService)
+		}
+	}
+	return ok
+}
+
+// addTipIfErr is addTip for errors which may be nil.
+func addTipIfErr(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	return addTip(ctx, err)
+}
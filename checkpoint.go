@@ -0,0 +1,47 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// timeBudget is how long a run starts processing domains, leaving time to
+// finish before the request deadline (10 minutes for cron on automatic
+// scaling). It defaults to 8 minutes and is configurable with the
+// AELE_TIME_BUDGET_MINUTES environment variable, from 1 to 1440.
+var timeBudget = time.Duration(envInt("AELE_TIME_BUDGET_MINUTES", 8, 1, 24*60)) * time.Minute
+
+// checkpointKind is the Datastore kind of the run checkpoint entity.
+const checkpointKind = "AELetsEncryptCheckpoint"
+
+// checkpoint is the Datastore entity of the domains a run deferred because
+// it ran out of time, which the next run processes first.
+type checkpoint struct {
+	Deferred []string `datastore:",noindex"`
+}
+
+// loadCheckpoint returns the domains deferred by the previous run.
+func loadCheckpoint(ctx context.Context) (map[string]bool, error) {
+	k := datastore.NewKey(ctx, checkpointKind, "default", 0, nil)
+	var c checkpoint
+	if err := datastore.Get(ctx, k, &c); err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, fmt.Errorf("datastore get: %v", err)
+	}
+	deferred := map[string]bool{}
+	for _, domain := range c.Deferred {
+		deferred[domain] = true
+	}
+	return deferred, nil
+}
+
+// saveCheckpoint saves the domains deferred by this run.
+func saveCheckpoint(ctx context.Context, deferred []string) error {
+	k := datastore.NewKey(ctx, checkpointKind, "default", 0, nil)
+	if _, err := datastore.Put(ctx, k, &checkpoint{Deferred: deferred}); err != nil {
+		return fmt.Errorf("datastore put: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/urlfetch"
+)
+
+// httpClient returns the HTTP client for outgoing requests: urlfetch on
+// AppEngine standard where it is required, net/http otherwise since urlfetch
+// is not available on the flexible environment.
+func httpClient(ctx context.Context) *http.Client {
+	if appengine.IsStandard() {
+		return urlfetch.Client(ctx)
+	}
+	return &http.Client{}
+}
+
+// validationClient returns an HTTP client fetching domains like CAs validating
+// http-01: following redirects, including to https, without verifying
+// certificates since the domain may not have a valid one yet, e.g. when
+// AppEngine redirects to https with "secure: always".
+func validationClient(ctx context.Context) *http.Client {
+	if appengine.IsStandard() {
+		return &http.Client{
+			Transport: &urlfetch.Transport{Context: ctx, AllowInvalidServerCertificate: true},
+		}
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+}
@@ -0,0 +1,110 @@
+package aeletsencrypt
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// configErr is the first invalid configuration found during initialization.
+// It is reported by the cron handler rather than silently ignored.
+var configErr error
+
+// wildcardDomains are base domains whose certificates also cover their
+// wildcard (e.g. example.com and *.example.com), read from the
+// comma-separated AELE_WILDCARD_DOMAINS environment variable.
+var wildcardDomains = envList("AELE_WILDCARD_DOMAINS")
+
+// excludeDomains are domains not managed, read from the comma-separated
+// AELE_EXCLUDE_DOMAINS environment variable. Entries starting with a dot
+// match subdomains (e.g. .internal.example.com).
+var excludeDomains = envList("AELE_EXCLUDE_DOMAINS")
+
+// includeDomains are, if set, the only domains managed, read from the
+// comma-separated AELE_INCLUDE_DOMAINS environment variable. Entries starting
+// with a dot match subdomains.
+var includeDomains = envList("AELE_INCLUDE_DOMAINS")
+
+// extraApps are the IDs of other AppEngine apps whose custom domains are also
+// managed, read from the comma-separated AELE_EXTRA_APPS environment variable.
+// The AppEngine default service account of this app needs the App Engine Admin
+// role on their projects, and to be a verified owner of their domains.
+var extraApps = envList("AELE_EXTRA_APPS")
+
+// envList reads a comma-separated list from an environment variable,
+// ignoring blank entries.
+func envList(name string) []string {
+	var list []string
+	for _, e := range strings.Split(os.Getenv(name), ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// envInt reads an integer from an environment variable, returning def if
+// unset. Values that are invalid or outside [min, max] are recorded in
+// configErr and def is returned instead.
+func envInt(name string, def, min, max int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err == nil && (n < min || n > max) {
+		err = fmt.Errorf("must be between %v and %v", min, max)
+	}
+	if err != nil {
+		if configErr == nil {
+			configErr = fmt.Errorf("invalid %v=%q: %v", name, v, err)
+		}
+		return def
+	}
+	return n
+}
+
+// certDomains returns the domains a certificate for a custom domain covers.
+func certDomains(domain string) []string {
+	for _, e := range wildcardDomains {
+		if strings.EqualFold(e, domain) {
+			return []string{domain, "*." + domain}
+		}
+	}
+	return []string{domain}
+}
+
+// matchDomain returns whether a domain matches any of the patterns,
+// case-insensitively: a pattern is either a domain or, starting with a dot,
+// a suffix matching its subdomains.
+func matchDomain(patterns []string, domain string) bool {
+	domain = strings.ToLower(domain)
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if domain == p || strings.HasPrefix(p, ".") && strings.HasSuffix(domain, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// unmanaged returns why a certificate for the domains is not managed
+// according to configuration, or "" if it is: it is excluded if any domain
+// is, and included if any domain is.
+func unmanaged(domains ...string) string {
+	included := len(includeDomains) == 0
+	for _, domain := range domains {
+		domain = strings.TrimPrefix(domain, "*.")
+		if matchDomain(excludeDomains, domain) {
+			return "excluded by config"
+		}
+		if matchDomain(includeDomains, domain) {
+			included = true
+		}
+	}
+	if !included {
+		return "not included by config"
+	}
+	return ""
+}
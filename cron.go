@@ -1,149 +1,1021 @@
 package aeletsencrypt
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
-	"golang.org/x/oauth2/google"
+	"golang.org/x/net/publicsuffix"
 	api "google.golang.org/api/appengine/v1beta"
 	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/user"
 )
 
 // updateBefore is the delay to update certificates before expiration.
-const updateBefore = 30 * 24 * time.Hour // 30 days
+// It defaults to 30 days and is configurable in days with the
+// AELE_RENEW_BEFORE_DAYS environment variable, from 1 to 89.
+var updateBefore = time.Duration(envInt("AELE_RENEW_BEFORE_DAYS", 30, 1, 89)) * 24 * time.Hour
 
-func init() {
-	http.HandleFunc("/.well-known/letsencrypt", cronHandler)
+// renewJitter spreads renewals of different certificates over several days
+// around updateBefore, so that apps do not all renew on the same day.
+// It defaults to 0 and is configurable in days with the
+// AELE_RENEW_JITTER_DAYS environment variable, from 0 to 30.
+var renewJitter = time.Duration(envInt("AELE_RENEW_JITTER_DAYS", 0, 0, 30)) * 24 * time.Hour
+
+// renewBefore returns the delay to update a certificate before expiration:
+// updateBefore shifted by up to renewJitter either way, deterministically per
+// certificate domains so that it does not change between runs, for 90 days
+// certificates, and proportionally less for certificates valid less long,
+// such as short-lived profiles.
+func renewBefore(c *api.AuthorizedCertificate) time.Duration {
+	const standard = 90 * 24 * time.Hour
+	before := updateBefore
+	if renewJitter > 0 {
+		h := fnv.New64a()
+		io.WriteString(h, strings.Join(c.DomainNames, ","))
+		before += time.Duration(h.Sum64()%uint64(2*renewJitter+1)) - renewJitter
+		if before < 24*time.Hour {
+			before = 24 * time.Hour
+		} else if before > 89*24*time.Hour {
+			before = 89 * 24 * time.Hour
+		}
+	}
+	if c.CertificateRawData == nil {
+		return before
+	}
+	chain, err := parseChain(c.CertificateRawData.PublicCertificate)
+	if err != nil {
+		return before
+	}
+	leaf := chainPath(chain)[0]
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	if lifetime >= standard {
+		return before
+	}
+	return time.Duration(float64(before) * float64(lifetime) / float64(standard))
+}
+
+// workers is the number of domains processed in parallel.
+// It defaults to 4 and is configurable with the AELE_WORKERS environment
+// variable, from 1 to 20.
+var workers = envInt("AELE_WORKERS", 4, 1, 20)
+
+// renewOnly is whether certificates are only updated, not created for custom
+// domains without one, set with the AELE_RENEW_ONLY=1 environment variable.
+var renewOnly = os.Getenv("AELE_RENEW_ONLY") == "1"
+
+// deleteOrphans is whether certificates not mapped to any domain are deleted
+// when expired, for domains no longer mapped, or superseded, set with the
+// AELE_DELETE_ORPHANS=1 environment variable.
+var deleteOrphans = os.Getenv("AELE_DELETE_ORPHANS") == "1"
+
+// maxRenewals is the maximum number of certificates updated per run, the
+// soonest expiring first, to spread renewals over several runs. It defaults
+// to 0 for no maximum and is configurable with the AELE_MAX_RENEWALS
+// environment variable, from 0 to 1000.
+var maxRenewals = envInt("AELE_MAX_RENEWALS", 0, 0, 1000)
+
+// groupDomains is whether custom domains sharing a registered domain
+// (e.g. example.com and www.example.com) get a single certificate, set with
+// the AELE_GROUP_DOMAINS=1 environment variable.
+var groupDomains = os.Getenv("AELE_GROUP_DOMAINS") == "1"
+
+// cronPath is the path the cron job handler is registered at. It defaults to
+// /.well-known/letsencrypt and is configurable with the AELE_CRON_PATH
+// environment variable, for apps already using this path. The admin handlers
+// are registered under it, e.g. cronPath/status.
+var cronPath = cronHandlerPath()
+
+// cronHandlerPath returns the configured cron job handler path, with a
+// leading slash and no trailing slash.
+func cronHandlerPath() string {
+	path := os.Getenv("AELE_CRON_PATH")
+	if path == "" {
+		return "/.well-known/letsencrypt"
+	}
+	return "/" + strings.Trim(path, "/")
 }
 
-// cronHandler is the cron job handler to create and update certificates.
+// cronHandler is the cron job handler to create and update certificates,
+// restricted to AppEngine cron and app admins whatever its path.
 func cronHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := appengine.NewContext(r)
 	if r.Header.Get("X-Appengine-Cron") == "" && !user.IsAdmin(ctx) {
 		http.Error(w, "unauthorized", http.StatusForbidden)
 		return
 	}
+	opts := defaultOptions()
+	opts.dryRun = opts.dryRun || r.FormValue("dryrun") == "1"
+	opts.force = r.FormValue("force") == "1"
+	opts.ignoreInterval = r.FormValue("ignore_interval") == "1"
+	if r.FormValue("format") == "json" {
+		opts.json = true
+		var b bytes.Buffer
+		err := createUpdate(ctx, &b, opts)
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(errorStatus(err))
+		}
+		b.WriteTo(w)
+		return
+	}
 	w.Header().Set("Content-Type", "text/plain")
-	if err := createUpdate(ctx, w); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	var err error
+	if opts == defaultOptions() {
+		err = RenewNow(ctx, w)
+	} else {
+		err = createUpdate(ctx, w, opts)
 	}
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+	}
+}
+
+// RenewNow creates and updates certificates as needed, like the cron job
+// handler, writing its progress to w. It lets apps trigger a run from their
+// own code, e.g. an admin page, without going through the handler.
+// The context must be an AppEngine request context.
+func RenewNow(ctx context.Context, w io.Writer) error {
+	return createUpdate(ctx, w, defaultOptions())
+}
+
+// options are the options of a run.
+type options struct {
+	dryRun         bool // only report what would be created or updated
+	force          bool // update all certificates regardless of expiry
+	ignoreInterval bool // run even if the last run was less than minRunInterval ago
+	json           bool // write a JSON report instead of progress
+}
+
+// defaultOptions returns the options of a run from configuration.
+func defaultOptions() options {
+	return options{dryRun: os.Getenv("AELE_DRY_RUN") == "1"}
 }
 
 // createUpdate creates and updates certificates as needed.
 // It uses the AppEngine Admin API as the AppEngine default service
 // account to list custom domains, creating certificates when missing, and to
 // list certificates, updating them before they expire.
-func createUpdate(ctx context.Context, w http.ResponseWriter) error {
-	appID := appengine.AppID(ctx)
-	client, err := google.DefaultClient(ctx, api.CloudPlatformScope)
+// A summary is emailed if configured, see notify.
+// With the json option, only a report of the run is written.
+func createUpdate(ctx context.Context, w io.Writer, opts options) (err error) {
+	r := &run{ctx: ctx, w: w, opts: opts, appID: appengine.AppID(ctx), start: time.Now()}
+	r.deadline = r.start.Add(timeBudget)
+	if d, ok := ctx.Deadline(); ok && d.Before(r.deadline) {
+		r.deadline = d
+	}
+	if opts.json {
+		defer func(w io.Writer) { r.writeReport(w, err) }(w)
+		w = ioutil.Discard
+		r.w = w
+	}
+	if configErr != nil {
+		return configErr
+	}
+	if !opts.ignoreInterval && !opts.dryRun {
+		if err := checkRunInterval(ctx); err != nil {
+			return err
+		}
+	}
+	defer func() {
+		notify(ctx, r.succeeded, r.critical, err)
+		postWebhook(ctx, r.results, r.critical, err)
+		if err != nil && len(r.failed) == 0 {
+			reportError(ctx, "", err)
+		}
+		if !opts.dryRun {
+			if err := saveStatus(ctx, r.runStatus(err)); err != nil {
+				log.Errorf(ctx, "save status: %v", err)
+			}
+		}
+	}()
+
+	if !skipPreflight && challengeApp == "" && challengePrefix == challengePath {
+		selfTest(ctx)
+	}
+	svc, err := newAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	if r.prioritized, err = loadCheckpoint(ctx); err != nil {
+		return err
+	}
+
+	if staging() {
+		fmt.Fprintf(w, "Using Let's Encrypt staging: certificates will not be trusted.\n\n")
+	}
+	if opts.dryRun {
+		fmt.Fprintf(w, "Dry-run: nothing will be created or updated.\n\n")
+		r.mark = " (dry-run)"
+	}
+	if opts.force {
+		fmt.Fprintf(w, "Force: all certificates will be updated regardless of expiry.\n\n")
+		log.Warningf(ctx, "app=%v: force mode, updating all certificates", r.appID)
+	}
+
+	for _, appID := range append([]string{r.appID}, extraApps...) {
+		if len(extraApps) > 0 {
+			fmt.Fprintf(w, "App %v:\n", appID)
+		}
+		r.appID = appID
+		if err := r.manage(svc); err != nil {
+			return err
+		}
+	}
+
+	if !opts.dryRun {
+		if err := saveCheckpoint(ctx, r.deferred); err != nil {
+			return err
+		}
+		if err := pruneHistory(ctx); err != nil {
+			return err
+		}
+	}
+	if len(r.deferred) > 0 {
+		fmt.Fprintf(w, "Time or issuance budget reached, deferred %v domains to the next run:\n - %v\n",
+			len(r.deferred), strings.Join(r.deferred, "\n - "))
+	}
+	if len(r.succeeded) > 0 {
+		fmt.Fprintf(w, "Succeeded for %v domains:\n - %v\n", len(r.succeeded), strings.Join(r.succeeded, "\n - "))
+	}
+	if len(r.failed) > 0 {
+		err := fmt.Errorf("failed for %v domains:\n%v", len(r.failed), strings.Join(r.failed, "\n"))
+		if kind := commonKind(r.failedKinds); kind != nil {
+			return &kindError{kind, err}
+		}
+		return err
+	}
+	return nil
+}
+
+// run is the state of a createUpdate run.
+type run struct {
+	ctx         context.Context
+	w           io.Writer
+	opts        options
+	appID       string
+	start       time.Time
+	deadline    time.Time            // after which no task starts, for all apps
+	issuances   int                  // tasks started, for all apps, see maxIssuances
+	mark        string               // appended to each domain line
+	prioritized map[string]bool      // deferred by the previous run, processed first
+	deferred    []string             // not processed for lack of time
+	succeeded   []string             // domain: action
+	failed      []string             // domain: error
+	failedKinds []error              // kind of each failure, see errorKind
+	critical    []string             // renewals failing close to expiry
+	expiries    map[string]time.Time // leaf expiry by domain, for metrics
+	chains      map[string]string    // chain by domain, see chainNames
+	results     []result
+	renewals    int       // certificates to update
+	skipped     int       // certificates not due for renewal
+	nextExpiry  time.Time // soonest expiry of managed certificates
+}
+
+// runStatus returns the status of the run for the status handler.
+func (r *run) runStatus(err error) *runStatus {
+	s := &runStatus{Time: r.start, Success: err == nil, Skipped: r.skipped, NextExpiry: r.nextExpiry,
+		State: "ok", Critical: r.critical}
 	if err != nil {
-		return fmt.Errorf("default client: %v", err)
+		s.Error = err.Error()
+		s.State = "failed"
+	}
+	if len(r.critical) > 0 {
+		s.State = "critical"
+	}
+	for domain := range r.expiries {
+		s.ExpiryDomains = append(s.ExpiryDomains, domain)
+	}
+	sort.Strings(s.ExpiryDomains)
+	for _, domain := range s.ExpiryDomains {
+		s.ExpiryTimes = append(s.ExpiryTimes, r.expiries[domain])
+		s.Chains = append(s.Chains, domainChain{Domain: domain, Chain: r.chains[domain]})
+	}
+	for _, res := range r.results {
+		switch res.Status {
+		case "created":
+			s.Created++
+		case "updated":
+			s.Renewed++
+		case "failed":
+			s.Failed++
+		}
+	}
+	return s
+}
+
+// result is the outcome of a domain in a run.
+type result struct {
+	Domain string `json:"domain"`
+	Status string `json:"status"`           // created, updated, bound, failed, skipped or pending (dry-run)
+	Expiry string `json:"expiry,omitempty"` // of its certificate, if known
+	Error  string `json:"error,omitempty"`
+}
+
+// report is the JSON report of a run.
+type report struct {
+	AppID   string   `json:"app_id"`
+	DryRun  bool     `json:"dry_run"`
+	Domains []result `json:"domains"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// writeReport writes the JSON report of the run, ended with an error or nil.
+func (r *run) writeReport(w io.Writer, err error) {
+	p := report{AppID: appengine.AppID(r.ctx), DryRun: r.opts.dryRun, Domains: r.results}
+	if p.Domains == nil {
+		p.Domains = []result{}
 	}
-	svc, err := api.New(client)
 	if err != nil {
-		return fmt.Errorf("api client: %v", err)
+		p.Error = err.Error()
 	}
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	if err := e.Encode(p); err != nil {
+		log.Errorf(r.ctx, "report: %v", err)
+	}
+}
 
-	dm, err := svc.Apps.DomainMappings.List(appID).Do()
+// manage creates and updates the certificates of the custom domains of the
+// app of the run.
+func (r *run) manage(svc admin) error {
+	if err := checkLocation(svc, r.appID); err != nil {
+		return addTip(r.ctx, err)
+	}
+	mappings, err := svc.ListDomainMappings(r.appID)
 	if err != nil {
-		return addTip(ctx, fmt.Errorf("list domains: %v", err))
+		return addTip(r.ctx, classify(fmt.Errorf("list domains: %v", err), err))
+	}
+	r.checkIncluded(mappings)
+	if len(mappings) == 0 {
+		fmt.Fprintf(r.w, "No custom domains, nothing to do: add custom domains to the app, see "+
+			"https://cloud.google.com/appengine/docs/standard/mapping-custom-domains\n\n")
+		log.Warningf(r.ctx, "app=%v: no custom domains, nothing to do", r.appID)
+		if !deleteOrphans {
+			// Certificates of no custom domain would only be renewed for nothing.
+			return nil
+		}
 	}
-	fmt.Fprintf(w, "Found %v custom domains:\n", len(dm.DomainMappings))
-	for _, e := range dm.DomainMappings {
+	var tasks []task
+	var names []string              // certificates to create, in order
+	groups := map[string][]string{} // certificate name to its domains
+	var existing []*api.AuthorizedCertificate
+	listed := false
+	fmt.Fprintf(r.w, "Found %v custom domains:\n", len(mappings))
+	for _, e := range mappings {
 		domain := e.Id
-		if e.SslSettings != nil {
-			fmt.Fprintf(w, " - %v: has certificate, nothing to do\n", domain)
+		if reason := unmanaged(domain); reason != "" {
+			r.skip(domain, time.Time{}, "%v", reason)
+			continue
+		}
+		if e.SslSettings != nil && e.SslSettings.SslManagementType == "AUTOMATIC" {
+			r.skip(domain, time.Time{}, "certificate managed by AppEngine, nothing to do")
+			continue
+		}
+		if e.SslSettings != nil && e.SslSettings.CertificateId != "" {
+			r.skip(domain, time.Time{}, "has certificate, nothing to do")
+			continue
+		}
+		if !listed {
+			if existing, err = svc.ListCertificates(r.appID); err != nil {
+				return addTip(r.ctx, classify(fmt.Errorf("list certificates: %v", err), err))
+			}
+			listed = true
+		}
+		if c := validCert(existing, domain); c != nil {
+			r.bind(svc, domain, c)
+			continue
+		}
+		if renewOnly {
+			r.skip(domain, time.Time{}, "no certificate, not creating (renew only)")
 			continue
 		}
-		fmt.Fprintf(w, " - %v: no certificate, creating\n", domain)
+		r.status(domain, "no certificate, creating")
+		name := domain
+		if groupDomains {
+			if registered, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil {
+				name = registered
+			}
+		}
+		if _, ok := groups[name]; !ok {
+			names = append(names, name)
+		}
+		groups[name] = append(groups[name], domain)
+	}
+	for _, name := range names {
+		name, domains := name, groups[name]
+		tasks = append(tasks, task{domain: name, domains: domains, action: "created", do: func() (string, error) {
+			return createCert(r.ctx, svc, r.appID, name, domains)
+		}})
+	}
+	r.runTasks(tasks)
+	fmt.Fprintln(r.w)
 
-		cert, key, err := obtainCert(ctx, domain)
+	certs, err := svc.ListCertificates(r.appID)
+	if err != nil {
+		return addTip(r.ctx, classify(fmt.Errorf("list certificates: %v", err), err))
+	}
+	tasks = nil
+	bound, covered := boundCerts(mappings, certs)
+	if maxRenewals > 0 {
+		// Renew the soonest expiring first.
+		sort.SliceStable(certs, func(i, j int) bool {
+			a, _ := certExpiry(certs[i])
+			b, _ := certExpiry(certs[j])
+			return a.Before(b)
+		})
+	}
+	fmt.Fprintf(r.w, "Found %v certificates:\n", len(certs))
+	for _, c := range certs {
+		c := c
+		domain := strings.Join(c.DomainNames, ", ")
+		if reason := unmanaged(c.DomainNames...); reason != "" {
+			r.skip(domain, time.Time{}, "%v", reason)
+			continue
+		}
+		if c.ManagedCertificate != nil {
+			r.skip(domain, time.Time{}, "certificate managed by AppEngine, nothing to do")
+			r.skipped++
+			continue
+		}
+		if !marked(c) {
+			r.skip(domain, time.Time{}, "certificate %q not uploaded by aeletsencrypt, nothing to do", c.DisplayName)
+			r.skipped++
+			continue
+		}
+		expire, err := certExpiry(c)
 		if err != nil {
-			return fmt.Errorf("obtain cert for %v: %v", domain, err)
+			r.fail(domain, fmt.Errorf("invalid expiry: %v", err))
+			continue
+		}
+		if superseded(c, bound, covered) {
+			r.skip(domain, expire, "superseded by a mapped certificate, nothing to do")
+			r.skipped++
+			continue
 		}
+		if r.nextExpiry.IsZero() || expire.Before(r.nextExpiry) {
+			r.nextExpiry = expire
+		}
+		if c.CertificateRawData != nil {
+			r.setCert(c.DomainNames, c.CertificateRawData.PublicCertificate)
+		}
+		days := int(time.Until(expire).Hours() / 24)
+		details := certDetails(c)
+		if !r.opts.force && time.Now().Add(renewBefore(c)).Before(expire) {
+			r.skip(domain, expire, "expires on %v (in %v days), %v, nothing to do", expire, days, details)
+			r.skipped++
+			continue
+		}
+		if maxRenewals > 0 && r.renewals >= maxRenewals {
+			r.skip(domain, expire, "expires on %v (in %v days), %v, postponed to a later run (at most %v renewals per run)",
+				expire, days, details, maxRenewals)
+			r.skipped++
+			continue
+		}
+		r.renewals++
+		r.status(domain, "expires on %v (in %v days), %v, updating", expire, days, details)
+		tasks = append(tasks, task{domain: domain, domains: c.DomainNames, action: "updated", expiry: expire, do: func() (string, error) {
+			return updateCert(r.ctx, svc, r.appID, c)
+		}})
+	}
+	r.runTasks(tasks)
+	fmt.Fprintln(r.w)
 
-		created, err := svc.Apps.AuthorizedCertificates.Create(appID, &api.AuthorizedCertificate{
-			CertificateRawData: &api.CertificateRawData{
-				PrivateKey:        key,
-				PublicCertificate: cert,
-			},
-			DisplayName: domain,
-		}).Do()
-		if err != nil {
-			return addTip(ctx, fmt.Errorf("create cert for %v: %v", domain, err))
+	if deleteOrphans {
+		r.cleanOrphans(svc, mappings, certs)
+	}
+	return nil
+}
+
+// status reports the status of a domain to the writer and logs it at Info
+// level, labeled with the app and domain.
+func (r *run) status(domain, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	fmt.Fprintf(r.w, " - %v: %v%v\n", domain, msg, r.mark)
+	log.Infof(r.ctx, "app=%v domain=%v: %v%v", r.appID, domain, msg, r.mark)
+}
+
+// skip reports a domain skipped like status, with the expiry of its
+// certificate if known.
+func (r *run) skip(domain string, expiry time.Time, format string, args ...interface{}) {
+	r.status(domain, format, args...)
+	r.results = append(r.results, result{Domain: domain, Status: "skipped", Expiry: formatExpiry(expiry)})
+}
+
+// formatExpiry formats an expiry for results, "" if unknown.
+func formatExpiry(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// fail reports a failure for a domain to the writer and logs it at Error
+// level, labeled with the app and domain, and to Error Reporting if enabled.
+func (r *run) fail(domain string, err error) {
+	fmt.Fprintf(r.w, " - %v: failed: %v\n", domain, err)
+	log.Errorf(r.ctx, "app=%v domain=%v: failed: %v", r.appID, domain, err)
+	r.failed = append(r.failed, fmt.Sprintf("%v: %v", domain, err))
+	r.failedKinds = append(r.failedKinds, errorKind(err))
+	r.results = append(r.results, result{Domain: domain, Status: "failed", Error: err.Error()})
+	reportError(r.ctx, domain, err)
+}
+
+// validCert returns the uploaded certificate covering a domain which expires
+// the latest, if it is not due for renewal, e.g. left unmapped by a previous
+// run which failed to map it, or nil if there is none.
+func validCert(certs []*api.AuthorizedCertificate, domain string) *api.AuthorizedCertificate {
+	var valid *api.AuthorizedCertificate
+	var validExpiry time.Time
+	for _, c := range certs {
+		if c.ManagedCertificate != nil || !marked(c) || !covers(c, certDomains(domain)) {
+			continue
+		}
+		expire, err := certExpiry(c)
+		if err != nil || !time.Now().Add(renewBefore(c)).Before(expire) {
+			continue
 		}
+		if valid == nil || expire.After(validExpiry) {
+			valid, validExpiry = c, expire
+		}
+	}
+	return valid
+}
 
-		_, err = svc.Apps.DomainMappings.Patch(appID, domain, &api.DomainMapping{
-			SslSettings: &api.SslSettings{
-				CertificateId: created.Id,
-			},
-		}).UpdateMask("ssl_settings.certificate_id").Do()
-		if err != nil {
-			return addTip(ctx, fmt.Errorf("update mapping for %v: %v", domain, err))
+// covers returns whether a certificate covers all domains.
+func covers(c *api.AuthorizedCertificate, domains []string) bool {
+	names := map[string]bool{}
+	for _, name := range c.DomainNames {
+		names[strings.ToLower(name)] = true
+	}
+	for _, domain := range domains {
+		if !names[strings.ToLower(domain)] {
+			return false
 		}
 	}
-	fmt.Fprintln(w)
+	return true
+}
 
-	ac, err := svc.Apps.AuthorizedCertificates.List(appID).Do()
-	if err != nil {
-		return addTip(ctx, fmt.Errorf("list certificates: %v", err))
+// bind maps an existing valid certificate to a custom domain without one,
+// rather than ordering a new certificate.
+func (r *run) bind(svc admin, domain string, c *api.AuthorizedCertificate) {
+	r.status(domain, "no certificate, binding existing certificate %v expiring on %v", c.Id, c.ExpireTime)
+	if r.opts.dryRun {
+		return
 	}
-	fmt.Fprintf(w, "Found %v certificates:\n", len(ac.Certificates))
-	for _, c := range ac.Certificates {
-		domain := c.DomainNames[0]
-		expire, err := time.Parse(time.RFC3339, c.ExpireTime)
-		if err != nil {
-			return fmt.Errorf("invalid expiry for %v: %v", domain, err)
+	if err := svc.SetDomainCertificate(r.appID, domain, c.Id); err != nil {
+		r.fail(domain, addTip(r.ctx, classify(fmt.Errorf("update mapping: %v", err), err)))
+		return
+	}
+	r.status(domain, "bound")
+	r.succeeded = append(r.succeeded, fmt.Sprintf("%v: bound", domain))
+	if c.CertificateRawData != nil {
+		r.setCert([]string{domain}, c.CertificateRawData.PublicCertificate)
+	}
+	expire, _ := certExpiry(c)
+	r.results = append(r.results, result{Domain: domain, Status: "bound", Expiry: formatExpiry(expire)})
+}
+
+// setCert records the leaf expiry and chain of the PEM encoded certificate
+// of domains, if valid.
+func (r *run) setCert(domains []string, cert string) {
+	expiry := notAfter(cert)
+	if expiry.IsZero() {
+		return
+	}
+	if r.expiries == nil {
+		r.expiries = map[string]time.Time{}
+		r.chains = map[string]string{}
+	}
+	for _, domain := range domains {
+		r.expiries[domain] = expiry
+		r.chains[domain] = certChain(cert)
+	}
+}
+
+// escalate reports loudly a certificate about to expire whose renewal failed
+// count consecutive runs, logging at Critical level and recording it for the
+// notification and status.
+func (r *run) escalate(domain string, expiry time.Time, count int, err error) {
+	msg := fmt.Sprintf("%v: expires on %v (in %v), renewal failed %v consecutive runs: %v",
+		domain, expiry, time.Until(expiry).Round(time.Hour), count, err)
+	fmt.Fprintf(r.w, " - CRITICAL: %v\n", msg)
+	log.Criticalf(r.ctx, "app=%v domain=%v: %v", r.appID, domain, msg)
+	r.critical = append(r.critical, msg)
+}
+
+// checkIncluded warns about included domains which are not custom domains.
+func (r *run) checkIncluded(mappings []*api.DomainMapping) {
+	mapped := map[string]bool{}
+	for _, e := range mappings {
+		mapped[strings.ToLower(e.Id)] = true
+	}
+	for _, domain := range includeDomains {
+		if strings.HasPrefix(domain, ".") || mapped[strings.ToLower(domain)] {
+			continue
+		}
+		fmt.Fprintf(r.w, "Warning: included domain %v is not a custom domain, ignoring.\n", domain)
+		log.Warningf(r.ctx, "app=%v domain=%v: included but not a custom domain, ignoring", r.appID, domain)
+	}
+}
+
+// boundCerts returns the IDs of certificates mapped to a domain, and the
+// domains they cover.
+func boundCerts(mappings []*api.DomainMapping, certs []*api.AuthorizedCertificate) (bound, covered map[string]bool) {
+	bound, covered = map[string]bool{}, map[string]bool{}
+	for _, e := range mappings {
+		if e.SslSettings != nil && e.SslSettings.CertificateId != "" {
+			bound[e.SslSettings.CertificateId] = true
+		}
+	}
+	for _, c := range certs {
+		if c.DomainMappingsCount > 0 {
+			bound[c.Id] = true
+		}
+		if bound[c.Id] {
+			for _, domain := range c.DomainNames {
+				covered[domain] = true
+			}
+		}
+	}
+	return bound, covered
+}
+
+// superseded returns whether a certificate is not mapped to any domain
+// while all its domains are covered by mapped certificates.
+func superseded(c *api.AuthorizedCertificate, bound, covered map[string]bool) bool {
+	if bound[c.Id] {
+		return false
+	}
+	for _, domain := range c.DomainNames {
+		if !covered[domain] {
+			return false
+		}
+	}
+	return true
+}
+
+// cleanOrphans deletes certificates not mapped to any domain which are
+// expired, for domains no longer mapped, or superseded by a mapped certificate
+// for the same domains.
+func (r *run) cleanOrphans(svc admin, mappings []*api.DomainMapping, certs []*api.AuthorizedCertificate) {
+	mapped := map[string]bool{} // custom domains
+	for _, e := range mappings {
+		mapped[e.Id] = true
+	}
+	bound, covered := boundCerts(mappings, certs)
+
+	var orphans []*api.AuthorizedCertificate
+	var reasons []string
+	for _, c := range certs {
+		if bound[c.Id] || c.ManagedCertificate != nil || !marked(c) || unmanaged(c.DomainNames...) != "" {
+			continue
+		}
+		expired, unmapped := false, true
+		if expire, err := time.Parse(time.RFC3339, c.ExpireTime); err == nil && time.Now().After(expire) {
+			expired = true
 		}
-		if time.Now().Add(updateBefore).Before(expire) {
-			fmt.Fprintf(w, " - %v: expires on %v, nothing to do\n", domain, expire)
+		for _, domain := range c.DomainNames {
+			if mapped[domain] {
+				unmapped = false
+			}
+		}
+		switch {
+		case expired:
+			reasons = append(reasons, "expired")
+		case unmapped && strings.HasSuffix(c.DisplayName, preissuedSuffix):
+			continue // domains not mapped yet
+		case unmapped:
+			reasons = append(reasons, "domains no longer mapped")
+		case superseded(c, bound, covered):
+			reasons = append(reasons, "superseded")
+		default:
 			continue
 		}
-		fmt.Fprintf(w, " - %v: expires on %v, updating\n", domain, expire)
+		orphans = append(orphans, c)
+	}
+	if len(orphans) == 0 {
+		return
+	}
 
-		cert, key, err := obtainCert(ctx, domain)
-		if err != nil {
-			return fmt.Errorf("obtain cert for %v: %v", domain, err)
+	fmt.Fprintf(r.w, "Found %v orphaned certificates:\n", len(orphans))
+	for i, c := range orphans {
+		domain := strings.Join(c.DomainNames, ", ")
+		r.status(domain, "%v, not mapped, deleting", reasons[i])
+		if r.opts.dryRun {
+			continue
+		}
+		if err := svc.DeleteCertificate(r.appID, c.Id); err != nil {
+			r.fail(domain, addTip(r.ctx, classify(fmt.Errorf("delete cert %v: %v", c.Id, err), err)))
+			continue
 		}
+		r.status(domain, "deleted")
+	}
+	fmt.Fprintln(r.w)
+}
+
+// task is a certificate creation or update for a domain.
+type task struct {
+	domain  string
+	domains []string               // covered by the certificate
+	action  string                 // reported on success
+	expiry  time.Time              // of the current certificate, if any
+	do      func() (string, error) // returns the PEM encoded certificate
+}
 
-		_, err = svc.Apps.AuthorizedCertificates.Patch(appID, c.Id, &api.AuthorizedCertificate{
-			CertificateRawData: &api.CertificateRawData{
-				PrivateKey:        key,
-				PublicCertificate: cert,
-			},
-		}).UpdateMask("certificate_raw_data").Do()
+// runTasks runs tasks with up to workers in parallel, then reports their
+// outcome in order. Tasks deferred by the previous run go first, and tasks
+// not started within the time budget or maxIssuances of the run, shared by
+// all apps, or stopped by the weekly budget, are deferred to the next run.
+// Tasks of domains the CA rate limited are skipped until it allows to retry.
+// Nothing is run in dry-run.
+func (r *run) runTasks(tasks []task) {
+	if r.opts.dryRun {
+		for _, t := range tasks {
+			r.results = append(r.results, result{Domain: t.domain, Status: "pending"})
+		}
+		return
+	}
+	var ready []task
+	for _, t := range tasks {
+		until, err := rateLimitedUntil(r.ctx, t.domain)
 		if err != nil {
-			return addTip(ctx, fmt.Errorf("update cert for %v: %v", domain, err))
+			r.fail(t.domain, err)
+			continue
 		}
+		if !until.IsZero() {
+			r.skip(t.domain, time.Time{}, "rate limited, skipping until %v (in %v)", until, time.Until(until).Round(time.Minute))
+			continue
+		}
+		ready = append(ready, t)
 	}
-	fmt.Fprintln(w)
-	return nil
+	tasks = ready
+	sort.SliceStable(tasks, func(i, j int) bool {
+		return r.prioritized[tasks[i].domain] && !r.prioritized[tasks[j].domain]
+	})
+	errs := make([]error, len(tasks))
+	certs := make([]string, len(tasks))
+	deferred := make([]bool, len(tasks))
+	sem := make(chan bool, workers)
+	var wg sync.WaitGroup
+	for i, t := range tasks {
+		sem <- true
+		if time.Now().After(r.deadline) || maxIssuances > 0 && r.issuances >= maxIssuances {
+			deferred[i] = true
+			<-sem
+			continue
+		}
+		r.issuances++
+		wg.Add(1)
+		go func(i int, t task) {
+			defer wg.Done()
+			certs[i], errs[i] = t.do()
+			<-sem
+		}(i, t)
+	}
+	wg.Wait()
+
+	for i, t := range tasks {
+		if deferred[i] {
+			r.skip(t.domain, time.Time{}, "deferred to the next run")
+			r.deferred = append(r.deferred, t.domain)
+			continue
+		}
+		if e, ok := errs[i].(*budgetError); ok {
+			r.skip(t.domain, time.Time{}, "%v", e)
+			r.deferred = append(r.deferred, t.domain)
+			continue
+		}
+		if e, ok := errs[i].(*limitError); ok {
+			r.skip(t.domain, time.Time{}, "%v", e)
+			continue
+		}
+		if e, ok := errs[i].(*propagationError); ok {
+			r.skip(t.domain, time.Time{}, "%v", e)
+			continue
+		}
+		if err := errs[i]; err != nil {
+			r.fail(t.domain, err)
+			if err := saveRetryAfter(r.ctx, t.domain, err); err != nil {
+				log.Errorf(r.ctx, "app=%v domain=%v: save retry after: %v", r.appID, t.domain, err)
+			}
+			count, errz := recordFailure(r.ctx, t.domain)
+			if errz != nil {
+				log.Errorf(r.ctx, "app=%v domain=%v: record failure: %v", r.appID, t.domain, errz)
+			}
+			if urgent(t.expiry, count) {
+				r.escalate(t.domain, t.expiry, count, err)
+			}
+			continue
+		}
+		if err := clearFailures(r.ctx, t.domain); err != nil {
+			log.Errorf(r.ctx, "app=%v domain=%v: clear failures: %v", r.appID, t.domain, err)
+		}
+		r.status(t.domain, "%v", t.action)
+		r.succeeded = append(r.succeeded, fmt.Sprintf("%v: %v", t.domain, t.action))
+		r.results = append(r.results, result{Domain: t.domain, Status: t.action, Expiry: formatExpiry(notAfter(certs[i]))})
+		r.setCert(t.domains, certs[i])
+	}
+}
+
+// displayNameTemplate is the display name of created certificates, where
+// {domain} is replaced by the certificate name and {date} by the issue date
+// (e.g. "{domain} ({date})"), read from the AELE_DISPLAY_NAME environment
+// variable. It defaults to {domain}.
+var displayNameTemplate = os.Getenv("AELE_DISPLAY_NAME")
+
+// displayNameMarker prefixes the display name of certificates uploaded by
+// this package, so that certificates uploaded otherwise, e.g. by hand in the
+// console, are left alone.
+const displayNameMarker = "aele:"
+
+// manageUnmarked is whether certificates without displayNameMarker are also
+// renewed and deleted, such as certificates uploaded by versions of this
+// package before it marked them, set with the AELE_MANAGE_UNMARKED=1
+// environment variable. They are marked when renewed.
+var manageUnmarked = os.Getenv("AELE_MANAGE_UNMARKED") == "1"
+
+// displayName returns the display name of a certificate created now.
+func displayName(name string) string {
+	if displayNameTemplate != "" {
+		name = strings.NewReplacer(
+			"{domain}", name,
+			"{date}", time.Now().UTC().Format("2006-01-02"),
+		).Replace(displayNameTemplate)
+	}
+	return displayNameMarker + name
+}
+
+// marked returns whether a certificate was uploaded by this package, or is
+// to be managed as such with manageUnmarked.
+func marked(c *api.AuthorizedCertificate) bool {
+	return manageUnmarked || strings.HasPrefix(c.DisplayName, displayNameMarker)
+}
+
+// createCert obtains a certificate for custom domains without one, uploads it
+// under a display name and maps it to the domains, returning it PEM encoded.
+func createCert(ctx context.Context, svc admin, appID, name string, domains []string) (chain string, err error) {
+	var cert string
+	defer func() { recordHistory(ctx, name, "created", cert, err) }()
+	var names []string
+	for _, domain := range domains {
+		names = append(names, certDomains(domain)...)
+	}
+	created, cert, err := uploadCert(ctx, svc, appID, name, displayName(name), names)
+	if err != nil {
+		return "", err
+	}
+
+	// Only the certificate is updated: the mapping resource records and the
+	// service routing (dispatch.yaml) are left untouched.
+	for _, domain := range domains {
+		if err := svc.SetDomainCertificate(appID, domain, created.Id); err != nil {
+			return "", addTip(ctx, classify(fmt.Errorf("update mapping for %v: %v", domain, err), err))
+		}
+	}
+	return cert, nil
+}
+
+// uploadCert obtains a certificate for names and creates it in an app under
+// a display name, without mapping it to any domain.
+func uploadCert(ctx context.Context, svc admin, appID, name, display string, names []string) (*api.AuthorizedCertificate, string, error) {
+	if err := checkAppEngineKeyType(keyTypeFor(names[0])); err != nil {
+		return nil, "", err
+	}
+	if err := preflight(ctx, names); err != nil {
+		return nil, "", err
+	}
+	if err := caa(ctx, names); err != nil {
+		return nil, "", err
+	}
+	if err := reserveIssuance(ctx, names); err != nil {
+		return nil, "", err
+	}
+	cert, key, err := ObtainCertificate(ctx, names)
+	if err != nil {
+		if err := releaseIssuance(ctx, names); err != nil {
+			log.Errorf(ctx, "release issuance: %v", err)
+		}
+		return nil, "", addTip(ctx, classify(fmt.Errorf("obtain cert: %v", err), err))
+	}
+
+	upload := &api.AuthorizedCertificate{
+		CertificateRawData: &api.CertificateRawData{
+			PrivateKey:        key,
+			PublicCertificate: cert,
+		},
+		DisplayName: display,
+	}
+	created, err := svc.CreateCertificate(appID, upload)
+	if err != nil && freeCertSlots && certLimitReached(err) {
+		if deleted, errz := deleteExpiredOrphan(ctx, svc, appID); errz != nil {
+			log.Errorf(ctx, "app=%v: free certificate slot: %v", appID, errz)
+		} else if deleted {
+			created, err = svc.CreateCertificate(appID, upload)
+		}
+	}
+	if err != nil {
+		return nil, cert, addTip(ctx, classify(keySizeTip(fmt.Errorf("create cert: %v", err), err, keyTypeFor(names[0])), err))
+	}
+	backup(ctx, name, cert, key)
+	return created, cert, nil
+}
+
+// updateCert obtains a new certificate for the domains of an existing one
+// and replaces it, returning the new one PEM encoded.
+func updateCert(ctx context.Context, svc admin, appID string, c *api.AuthorizedCertificate) (chain string, err error) {
+	var cert string
+	defer func() { recordHistory(ctx, strings.Join(c.DomainNames, ", "), "updated", cert, err) }()
+	if err := checkAppEngineKeyType(keyTypeFor(c.DomainNames[0])); err != nil {
+		return "", err
+	}
+	if err := preflight(ctx, c.DomainNames); err != nil {
+		return "", err
+	}
+	if err := caa(ctx, c.DomainNames); err != nil {
+		return "", err
+	}
+	if err := reserveIssuance(ctx, c.DomainNames); err != nil {
+		return "", err
+	}
+	cert, key, err := ObtainCertificate(ctx, c.DomainNames)
+	if err != nil {
+		if err := releaseIssuance(ctx, c.DomainNames); err != nil {
+			log.Errorf(ctx, "release issuance: %v", err)
+		}
+		return "", addTip(ctx, classify(fmt.Errorf("obtain cert: %v", err), err))
+	}
+
+	name := c.DisplayName
+	if !strings.HasPrefix(name, displayNameMarker) {
+		name = displayNameMarker + name
+	}
+	if err = svc.UpdateCertificate(appID, c.Id, name, cert, key); err != nil {
+		return "", addTip(ctx, classify(keySizeTip(fmt.Errorf("update cert: %v", err), err, keyTypeFor(c.DomainNames[0])), err))
+	}
+	backup(ctx, c.DomainNames[0], cert, key)
+	return cert, nil
 }
 
+// addTip adds to errors of a known kind a tip to fix them.
 func addTip(ctx context.Context, err error) error {
 	appID := appengine.AppID(ctx)
 	serviceAccount, errz := appengine.ServiceAccount(ctx)
 	if errz != nil {
 		serviceAccount = "n/a"
 	}
-	switch {
-	case strings.Contains(err.Error(), "Quota configuration not found"),
-		strings.Contains(err.Error(), "Google App Engine Admin API has not been used"):
-		return fmt.Errorf("%v\nTip: enable Google App Engine Admin API on "+
-			"https://console.cloud.google.com/apis/api/appengine.googleapis.com/overview?project=%s",
-			err, appID)
-	case strings.Contains(err.Error(), "Operation not allowed, forbidden"):
-		return fmt.Errorf("%v\nTip: add AppEngine default service account (%s) to role App Engine Admin "+
-			"https://console.cloud.google.com/iam-admin/iam/project?project=%s",
-			err, serviceAccount, appID)
-	case strings.Contains(err.Error(), "Caller is not authorized to administer this certificate"):
-		return fmt.Errorf("%v\nTip: add AppEngine default service account (%s) as verified owner for the domain"+
-			"https://www.google.com/webmasters/verification/details",
-			err, serviceAccount)
-	}
-	return err
+	var tip string
+	switch errorKind(err) {
+	case ErrAPINotEnabled:
+		tip = fmt.Sprintf("Tip: enable Google App Engine Admin API on "+
+			"https://console.cloud.google.com/apis/api/appengine.googleapis.com/overview?project=%s", appID)
+	case ErrPermissionDenied:
+		tip = fmt.Sprintf("Tip: add AppEngine default service account (%s) to role App Engine Admin "+
+			"https://console.cloud.google.com/iam-admin/iam/project?project=%s", serviceAccount, appID)
+	case ErrDomainUnverified:
+		tip = fmt.Sprintf("Tip: add AppEngine default service account (%s) as verified owner for the domain"+
+			"https://www.google.com/webmasters/verification/details", serviceAccount)
+	case ErrRateLimited:
+		tip = "Tip: Let's Encrypt rate limits are per week (https://letsencrypt.org/docs/rate-limits/), " +
+			"skipping this domain until the next cron job"
+		if m := retryAfterRE.FindStringSubmatch(err.Error()); m != nil {
+			tip += " after " + m[1]
+		}
+	case ErrCertificateLimit:
+		tip = fmt.Sprintf("Tip: AppEngine limits the number of certificates of an app, delete unused ones on "+
+			"https://console.cloud.google.com/appengine/settings/certificates?project=%s, or set "+
+			"AELE_DELETE_ORPHANS=1 or AELE_FREE_CERT_SLOTS=1 to have them deleted", appID)
+	default:
+		return err
+	}
+	return classify(fmt.Errorf("%v\n%v", err, tip), err)
 }
+
+// errorStatus returns the HTTP status code of an error, by kind: 403 for
+// permissions the user must grant, 429 for rate limits (including runs in
+// quick succession), 500 otherwise.
+func errorStatus(err error) int {
+	switch errorKind(err) {
+	case ErrPermissionDenied, ErrDomainUnverified:
+		return http.StatusForbidden
+	case ErrRateLimited:
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+// retryAfterRE matches when a rate limit resets in Let's Encrypt errors,
+// or as added by withRetryAfter.
+var retryAfterRE = regexp.MustCompile(`retry after (\d{4}-\d{2}-\d{2}[ T]\d{2}:\d{2}:\d{2}(?: UTC|Z))`)
@@ -0,0 +1,134 @@
+package aeletsencrypt
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	api "google.golang.org/api/appengine/v1beta"
+)
+
+func TestManage(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		mappings []*api.DomainMapping
+		certs    func(t *testing.T) []*api.AuthorizedCertificate
+		created  int
+		updated  []string
+		skipped  int
+		results  []result // without expiry
+	}{
+		{
+			name:     "create",
+			mappings: []*api.DomainMapping{{Id: "example.com"}},
+			created:  1,
+			skipped:  1, // once created
+			results: []result{
+				{Domain: "example.com", Status: "created"},
+				{Domain: "example.com", Status: "skipped"},
+			},
+		},
+		{
+			name: "renew",
+			mappings: []*api.DomainMapping{
+				{Id: "example.com", SslSettings: &api.SslSettings{CertificateId: "1"}},
+			},
+			certs: func(t *testing.T) []*api.AuthorizedCertificate {
+				return []*api.AuthorizedCertificate{testCertificate(t, "1", []string{"example.com"}, 10*24*time.Hour)}
+			},
+			updated: []string{"1"},
+			results: []result{
+				{Domain: "example.com", Status: "skipped"},
+				{Domain: "example.com", Status: "updated"},
+			},
+		},
+		{
+			name: "skip AUTOMATIC",
+			mappings: []*api.DomainMapping{
+				{Id: "example.com", SslSettings: &api.SslSettings{CertificateId: "1", SslManagementType: "AUTOMATIC"}},
+			},
+			certs: func(t *testing.T) []*api.AuthorizedCertificate {
+				c := testCertificate(t, "1", []string{"example.com"}, 10*24*time.Hour)
+				c.ManagedCertificate = &api.ManagedCertificate{Status: "OK"}
+				return []*api.AuthorizedCertificate{c}
+			},
+			skipped: 1,
+			results: []result{
+				{Domain: "example.com", Status: "skipped"},
+				{Domain: "example.com", Status: "skipped"},
+			},
+		},
+		{
+			name: "skip unexpired",
+			mappings: []*api.DomainMapping{
+				{Id: "example.com", SslSettings: &api.SslSettings{CertificateId: "1"}},
+			},
+			certs: func(t *testing.T) []*api.AuthorizedCertificate {
+				return []*api.AuthorizedCertificate{testCertificate(t, "1", []string{"example.com"}, 80*24*time.Hour)}
+			},
+			skipped: 1,
+			results: []result{
+				{Domain: "example.com", Status: "skipped"},
+				{Domain: "example.com", Status: "skipped"},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, _ := newTestContext(t)
+			ca := newTestCA(t, ctx)
+			var certs []*api.AuthorizedCertificate
+			if tt.certs != nil {
+				certs = tt.certs(t)
+			}
+			svc := newFakeAdmin(t, tt.mappings, certs)
+			var w bytes.Buffer
+			r := &run{ctx: ctx, w: &w, appID: testAppID, start: time.Now(), deadline: time.Now().Add(time.Minute)}
+			if err := r.manage(svc); err != nil {
+				t.Fatalf("manage: %v", err)
+			}
+			if got := len(svc.created); got != tt.created {
+				t.Errorf("created %v certificates, want %v", got, tt.created)
+			}
+			if !reflect.DeepEqual(svc.updated, tt.updated) {
+				t.Errorf("updated certificates %v, want %v", svc.updated, tt.updated)
+			}
+			if got, want := len(ca.csrs), tt.created+len(tt.updated); got != want {
+				t.Errorf("ordered %v certificates, want %v", got, want)
+			}
+			if r.skipped != tt.skipped {
+				t.Errorf("skipped %v certificates, want %v", r.skipped, tt.skipped)
+			}
+			var results []result
+			for _, res := range r.results {
+				res.Expiry = ""
+				results = append(results, res)
+			}
+			if !reflect.DeepEqual(results, tt.results) {
+				t.Errorf("results %+v, want %+v", results, tt.results)
+			}
+		})
+	}
+}
+
+func TestManageKeepsResourceRecords(t *testing.T) {
+	ctx, _ := newTestContext(t)
+	newTestCA(t, ctx)
+	records := []*api.ResourceRecord{{Name: "example.com", Rrdata: "216.239.32.21", Type: "A"}}
+	svc := newFakeAdmin(t, []*api.DomainMapping{{
+		Id:              "example.com",
+		ResourceRecords: records,
+		SslSettings:     &api.SslSettings{SslManagementType: "MANUAL"},
+	}}, nil)
+	r := &run{ctx: ctx, w: &bytes.Buffer{}, appID: testAppID, start: time.Now(), deadline: time.Now().Add(time.Minute)}
+	if err := r.manage(svc); err != nil {
+		t.Fatalf("manage: %v", err)
+	}
+	m := svc.mappings["example.com"]
+	if want := (&api.SslSettings{CertificateId: "1", SslManagementType: "MANUAL"}); !reflect.DeepEqual(m.SslSettings, want) {
+		t.Errorf("SSL settings %+v, want %+v", m.SslSettings, want)
+	}
+	if !reflect.DeepEqual(m.ResourceRecords, records) {
+		t.Errorf("resource records %+v, want %+v", m.ResourceRecords, records)
+	}
+}
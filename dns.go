@@ -0,0 +1,99 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2/google"
+	dns "google.golang.org/api/dns/v1"
+	"google.golang.org/appengine"
+)
+
+// updateRecord updates the TXT record of a dns-01 challenge. It is a variable
+// so that Cloud DNS can be replaced, e.g. by a fake.
+var updateRecord = updateTXT
+
+// updateTXT adds or removes a value from the TXT record of name (fully
+// qualified, with trailing dot) for the dns-01 challenge.
+// It uses the Cloud DNS API as the AppEngine default service account to find
+// the managed zone of the app project containing name, and waits for the
+// change to be applied.
+func updateTXT(ctx context.Context, name, value string, add bool) error {
+	project := appengine.AppID(ctx)
+	client, err := google.DefaultClient(ctx, dns.NdevClouddnsReadwriteScope)
+	if err != nil {
+		return fmt.Errorf("default client: %v", err)
+	}
+	svc, err := dns.New(client)
+	if err != nil {
+		return fmt.Errorf("dns client: %v", err)
+	}
+
+	zones, err := svc.ManagedZones.List(project).Do()
+	if err != nil {
+		return fmt.Errorf("list zones: %v", err)
+	}
+	var zone *dns.ManagedZone
+	for _, z := range zones.ManagedZones {
+		if !strings.HasSuffix(name, "."+z.DnsName) {
+			continue
+		}
+		if zone == nil || len(z.DnsName) > len(zone.DnsName) {
+			zone = z
+		}
+	}
+	if zone == nil {
+		return fmt.Errorf("no managed zone for %v", name)
+	}
+
+	rrsets, err := svc.ResourceRecordSets.List(project, zone.Name).Name(name).Type("TXT").Do()
+	if err != nil {
+		return fmt.Errorf("list records: %v", err)
+	}
+	change := &dns.Change{}
+	var values []string
+	for _, rr := range rrsets.Rrsets {
+		change.Deletions = append(change.Deletions, rr)
+		values = append(values, rr.Rrdatas...)
+	}
+	quoted := `"` + value + `"`
+	if add {
+		values = append(values, quoted)
+	} else {
+		for i, v := range values {
+			if v == quoted {
+				values = append(values[:i], values[i+1:]...)
+				break
+			}
+		}
+	}
+	if len(values) > 0 {
+		change.Additions = []*dns.ResourceRecordSet{{
+			Name:    name,
+			Type:    "TXT",
+			Ttl:     60,
+			Rrdatas: values,
+		}}
+	}
+	if len(change.Deletions) == 0 && len(change.Additions) == 0 {
+		return nil
+	}
+
+	c, err := svc.Changes.Create(project, zone.Name, change).Do()
+	if err != nil {
+		return fmt.Errorf("create change: %v", err)
+	}
+	for c.Status != "done" {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+		if c, err = svc.Changes.Get(project, zone.Name, c.Id).Do(); err != nil {
+			return fmt.Errorf("get change: %v", err)
+		}
+	}
+	return nil
+}
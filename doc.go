@@ -7,12 +7,22 @@ Package initialization registers an HTTP handler at /.well-known/letsencrypt
 restricted to app admins and AppEngine cron, which calls it daily.
 This handler uses the AppEngine Admin API as the AppEngine default service
 account to list custom domains, creating certificates when missing, and to
-list certificates, updating them 30 days before they expire.
-To create and update certificates with LetsEncrypt it creates a temporary
-account key, resolves the http-01 challenge for domain validation,
+list certificates, updating them 30 days before they expire (configurable
+with the AELE_RENEW_BEFORE_DAYS environment variable, from 1 to 89 days, and
+spread by up to AELE_RENEW_JITTER_DAYS either way, stable per certificate),
+processing up to 4 domains in parallel (configurable with AELE_WORKERS).
+To spread renewals over several runs, set AELE_MAX_RENEWALS to the maximum
+number of certificates updated per run, the soonest expiring first.
+Expiry is as reported by the Admin API, or with AELE_LEAF_EXPIRY=1 read from
+the leaf certificate itself.
+To create and update certificates with LetsEncrypt it uses an account
+registered on first use, resolves the http-01 challenge for domain validation,
 creates a certificate key and request, receives the signed certificate with
 its chain and uploads it to AppEngine along with the key.
-Nothing is saved in the app itself.
+Only the account key and pending challenges are saved in the app itself,
+in Datastore. Challenges are deleted once validated, and expire after 10
+minutes otherwise (configurable with AELE_CHALLENGE_TTL_MINUTES, e.g. for
+slow CAs).
 
 Setup
 
@@ -34,11 +44,16 @@ initialization it registers its handlers.
 		_ "github.com/StalkR/aeletsencrypt"
 	)
 
+Apps using their own router can set AELE_NO_DEFAULT_HANDLERS=1 so that
+initialization leaves http.DefaultServeMux alone, and register the handlers
+on a mux of their own with RegisterHandlers instead, mounting it in their
+router for /.well-known/ (or the paths configured below).
+
 Add the following handlers to your app.yaml:
 
 	handlers:
-	# Cron job handler to create and update certificates
-	- url: /.well-known/letsencrypt
+	# Cron job and admin handlers to create and update certificates
+	- url: /.well-known/letsencrypt(/.*)?
 	  script: _go_app
 	  secure: optional
 	  login: admin
@@ -48,7 +63,34 @@ Add the following handlers to your app.yaml:
 	  secure: optional
 
 Handlers order matter, so insert above more generic handlers (e.g /.*).
+CAs validate http-01 over http on port 80 only, so no other port can be used.
+The first run on an instance checks the challenge handler is reachable there
+and logs a warning if another handler appears to shadow it.
+With several services, custom domains are routed to them by dispatch.yaml:
+the challenge handler must be reachable on each domain from a service
+importing this package, not necessarily the one running the cron job, as
+challenges are shared by all services of the app. Certificates are set on
+domain mappings without changing their routing. To have challenges of all
+domains served by one service, set AELE_CHALLENGE_SERVICE to its name:
+domains whose dispatch.yaml rules route challenges to another service are
+logged with a warning before ordering, and reported by the check handler.
+Before ordering a certificate, each domain is checked to reach the app at
+/.well-known/acme-challenge/ping, so that domains whose DNS does not point to
+AppEngine yet are skipped (set AELE_SKIP_PREFLIGHT=1 to disable). To give
+DNS of new domains time to propagate, a domain is checked again twice, 30
+seconds apart (configurable with AELE_PROPAGATION_RETRIES and
+AELE_PROPAGATION_DELAY_SECONDS), before it is skipped until the next run
+without counting as a failure.
+Set AELE_CHECK_CAA=1 to also check that the CAA records of each domain, if
+any, authorize the CA (set AELE_CAA_IDENTITY for CAs other than Let's Encrypt
+and Google Public CA).
 The "secure: optional" is to avoid https redirect, which might not work yet.
+With "secure: always" the challenge handler is reached over https instead,
+which also works: CAs follow the redirect without verifying the certificate.
+If /.well-known/ is routed elsewhere, for instance to another service which
+forwards challenges, set AELE_CHALLENGE_PATH to the path prefix the challenge
+handler should be registered at instead (e.g. /aele/challenge/): a request to
+<prefix><token> is answered as /.well-known/acme-challenge/<token>.
 
 Add the following cron jobs to your cron.yaml, creating it if necessary:
 
@@ -57,6 +99,16 @@ Add the following cron jobs to your cron.yaml, creating it if necessary:
 	  url: /.well-known/letsencrypt
 	  schedule: every 24 hours
 
+If /.well-known/letsencrypt is already used, set AELE_CRON_PATH to the path
+the cron job handler should be registered at instead (e.g. /aele/cron), and
+use it in cron.yaml, app.yaml and the URLs below. It remains restricted to
+AppEngine cron and app admins; the other handlers move under it as well
+(e.g. /aele/cron/status), except the ACME challenge handler.
+
+To check which certificates would be created or updated without doing it,
+visit http://<any custom domain>/.well-known/letsencrypt?dryrun=1 or set the
+AELE_DRY_RUN=1 environment variable.
+
 At this point you are done, certificates for all custom domains will be created
 next time the cron job runs. To create certificates immediately, run the cron
 job now by visiting http://<any custom domain>/.well-known/letsencrypt.
@@ -65,8 +117,249 @@ If you have several domains be mindful of
 Let's Encrypt rate-limits (https://letsencrypt.org/docs/rate-limits/) in
 particular 20 domains per week. If you hit this limit, just wait a week and
 let the cron job resume certificate creation for the remaining domains.
+To use fewer certificates, set the AELE_GROUP_DOMAINS=1 environment variable:
+custom domains sharing a registered domain (e.g. example.com, www.example.com
+and blog.example.com) then get a single certificate covering all of them.
+Certificates are named after their domain, or as set with the
+AELE_DISPLAY_NAME environment variable where {domain} is replaced by the
+domain and {date} by the issue date, e.g. "{domain} ({date})".
+Their display names are prefixed with "aele:" to tell them apart from
+certificates uploaded otherwise, e.g. by hand in the console, which are never
+renewed nor deleted. Certificates uploaded by earlier versions are not
+marked: set AELE_MANAGE_UNMARKED=1 until they have been renewed once, which
+marks them, or renew them with the renew handler below.
+
+To leave some custom domains alone, for instance when their certificates are
+managed elsewhere, list them in the comma-separated AELE_EXCLUDE_DOMAINS
+environment variable. Entries starting with a dot exclude all subdomains
+(e.g. .internal.example.com). Conversely, to only manage some custom domains,
+for instance to try on one first, list them in AELE_INCLUDE_DOMAINS.
+To create certificates by hand and only have them renewed, e.g. for staged
+adoption or domains needing manual validation, set AELE_RENEW_ONLY=1: custom
+domains without a certificate are then listed but skipped.
+Custom domains without a certificate are bound to an existing one covering
+them and not due for renewal if there is one, e.g. uploaded by a previous run
+which failed to bind it, rather than ordering a new one.
+
+To create or update the certificate of a single custom domain immediately,
+regardless of its expiry, visit
+http://<any custom domain>/.well-known/letsencrypt/renew?domain=<domain>.
+
+To have a certificate ready for a domain about to be added as a custom domain,
+visit http://<any custom domain>/.well-known/letsencrypt/preissue?domain=<domain>:
+it creates the certificate without mapping it, and the next run binds it once
+the domain is added. With http-01, the domain must already reach the app,
+otherwise prefer dns-01 with AELE_CHALLENGE_TYPES. Pre-issued certificates are
+not deleted as orphans while their domain is not mapped.
+
+To verify the setup without ordering any certificate, visit
+http://<any custom domain>/.well-known/letsencrypt/check: it checks the
+configuration, Admin API access and permissions, and that each custom domain
+serves challenges, with tips on failures.
+
+For monitoring, http://<any custom domain>/.well-known/letsencrypt/status
+reports the last run as JSON: time, success, counts of created, renewed,
+skipped and failed certificates, the soonest upcoming expiry, the chain of
+the certificate of each domain from the leaf up to the root (e.g.
+"www.example.com -> R3 -> ISRG Root X1", also shown for each domain in the run
+output) to tell which intermediate is used, and a state:
+ok, failed, or critical when a certificate expires within 7 days and its
+renewal failed 2 consecutive runs (configurable with AELE_ESCALATE_DAYS and
+AELE_ESCALATE_FAILURES). Critical renewals are also logged at Critical level
+and listed in the notification email, marked urgent, and webhook.
+For alerting, http://<any custom domain>/.well-known/letsencrypt/metrics
+exports in OpenMetrics text format the aele_last_run_timestamp_seconds and
+aele_cert_expiry_seconds{domain="..."} gauges, the latter from the leaf of
+the certificate of each domain as of the last run, e.g. to alert on
+aele_cert_expiry_seconds - time() < 14 * 86400.
+Certificate creations and updates are recorded for auditing, with their
+serial, issuer, expiry or error, and the last ones (50 or the n parameter)
+listed at http://<any custom domain>/.well-known/letsencrypt/history. They are
+kept 90 days, configurable with AELE_HISTORY_DAYS.
+The certificate bound to each custom domain is listed with the SHA-256
+fingerprint, issuer and validity of its leaf at
+http://<any custom domain>/.well-known/letsencrypt/certificates.
+
+Each ACME operation times out after 60 seconds (configurable with
+AELE_ACME_TIMEOUT_SECONDS), so that a CA not responding fails one domain
+rather than the whole run.
+Runs stop starting new domains after 8 minutes (configurable with
+AELE_TIME_BUDGET_MINUTES) to finish before the request deadline; remaining
+domains are processed first by the next run. Domains rate limited by the CA
+are skipped until the time it allows to retry, if it tells.
+To stay within Let's Encrypt rate limits, no more than 50 certificates per
+registered domain (e.g. example.com for www.example.com) are ordered in a
+rolling week, configurable with AELE_WEEKLY_LIMIT.
+To keep large fleets within a budget whatever the CA, set AELE_WEEKLY_BUDGET
+to the maximum number of certificates ordered for all domains in a rolling
+week, and AELE_MAX_ISSUANCES to the maximum number of certificates created or
+updated per run. Domains over budget are deferred to the next runs, which
+process them first.
+
+Certificates not mapped to any domain are kept, unless the
+AELE_DELETE_ORPHANS=1 environment variable is set: they are then deleted when
+expired, for domains no longer mapped, or superseded by a mapped certificate.
+AppEngine limits the number of certificates of an app: to have uploads
+failing on this limit retried once after deleting the longest expired
+certificate not mapped to any domain, set AELE_FREE_CERT_SLOTS=1.
+
+To update all certificates regardless of their expiry, for instance after a
+key compromise or switching CA, visit
+http://<any custom domain>/.well-known/letsencrypt?force=1.
+
+For automation, add format=json to the cron handler parameters to have the
+outcome of the run returned as JSON rather than its progress as text: each
+domain with its status (created, updated, bound, failed, skipped, or pending
+in dry-run), the expiry of its certificate when known, and any error.
+
+Runs less than an hour after the previous one are refused, so that visiting
+the cron handler repeatedly does not exhaust rate limits, including with
+force=1. To run anyway, add ignore_interval=1 to the cron handler parameters.
+The interval is configurable with AELE_MIN_RUN_INTERVAL_MINUTES (0 disables).
 
 If you add new custom domains later, the cron job will automatically create
 certificates next time it runs.
+
+To test the setup without consuming Let's Encrypt rate limits, set the
+AELE_ACME_STAGING=1 environment variable to use the staging environment
+(https://letsencrypt.org/docs/staging-environment/). Certificates it issues
+are not trusted by browsers, so once the setup works remove it and delete the
+staging certificates from the console so they are created again.
+
+To be emailed a summary of runs creating or updating certificates or failing,
+set the AELE_NOTIFY_EMAIL environment variable to the recipient address.
+To have a JSON summary of each run posted to a webhook, such as a Slack
+incoming webhook, set AELE_WEBHOOK_URL. To report failures to Cloud Error
+Reporting, grouped with the domain and ACME or Admin API error type, set
+AELE_ERROR_REPORTING=1.
+
+Webhook posts failing with a network or server error are retried with
+exponential backoff, AELE_WEBHOOK_RETRIES times (default 2, at most 5). To let
+receivers verify payloads, set AELE_WEBHOOK_SECRET to a secret shared with
+them: posts then have an X-Aeletsencrypt-Signature header t=<time>,v1=<sig>,
+where <time> is the Unix time of the post and <sig> the hex HMAC-SHA256 with
+the secret of <time>, a dot and the body. Receivers should recompute it,
+compare it in constant time, and reject times more than a few minutes old to
+prevent replays.
+
+To back up issued certificates and keys, set AELE_BACKUP_BUCKET to a Cloud
+Storage bucket the AppEngine default service account can write to: they are
+saved as <domain>/<issue time>/cert.pem and key.pem. Set
+AELE_BACKUP_CERT_ONLY=1 to only archive certificates, not their keys.
+
+Requests to CAs and the Admin API identify the app with the User-Agent
+aeletsencrypt/<version> (+<app ID>), where <version> is the version of this
+module the app is built with. Set AELE_USER_AGENT to replace it.
+
+To receive expiry warnings and notices from the CA, set AELE_ACCOUNT_EMAIL to
+the contact email address of the account.
+The CA terms of service are accepted when registering the account. To only
+accept terms reviewed beforehand, set AELE_ACCEPTED_TOS_URL to their URL:
+registration is refused if the CA terms changed.
+To keep the account key out of the app, set AELE_ACCOUNT_KMS_KEY to a Cloud
+KMS RSA PKCS#1 SHA-256 signing key version (projects/.../cryptoKeyVersions/1)
+on which the AppEngine default service account has the Cloud KMS CryptoKey
+Signer/Verifier role: ACME requests are then signed by KMS, and a new account
+is registered with it. Certificate keys cannot be held in KMS as AppEngine
+needs them to serve certificates, so they are still generated by the app.
+
+To use another ACME CA than Let's Encrypt, set the AELE_ACME_DIRECTORY
+environment variable to its directory URL, and if it requires External
+Account Binding, AELE_EAB_KID and AELE_EAB_HMAC_KEY (base64url encoded) to
+the credentials it provides.
+
+To use Google Public CA, set AELE_ACME_CA=google: External Account Binding
+credentials are then created with its API as the AppEngine default service
+account, which needs the Public CA External Account Key Creator role.
+To fall back to another CA when the primary one is rate limiting or
+unavailable, set AELE_ACME_FALLBACK_DIRECTORY to its directory URL, and if it
+requires External Account Binding, AELE_FALLBACK_EAB_KID and
+AELE_FALLBACK_EAB_HMAC_KEY. The CA issuing each certificate is logged.
+
+To also manage the custom domains of other AppEngine apps, list their IDs in
+the comma-separated AELE_EXTRA_APPS environment variable. The AppEngine default
+service account of this app then needs the App Engine Admin role on their
+projects, and to be a verified owner of their domains. The other apps must
+import this package with AELE_CHALLENGE_APP set to the ID of this app, so that
+they redirect challenges to it.
+
+Set AELE_LOCATION to the location (region) of the managed apps, e.g.
+us-central, to have runs fail rather than manage the custom domains of an app
+in another location. The location of each app is then read from the Admin API
+once per instance.
+
+Outside the AppEngine standard environment, such as on the flexible
+environment, outgoing requests are made with net/http rather than urlfetch,
+and challenge responses and tls-alpn-01 certificates are only stored in
+Datastore, without memcache, so that every instance serves them. The
+AppEngine APIs the package uses (Datastore for challenges, accounts and run
+state, users, mail, logging) must be reachable, e.g. Datastore through the
+Cloud Datastore API. Otherwise, to manage the custom domains of a flexible
+app, run the package in a standard app listing it in AELE_EXTRA_APPS, and have
+the flexible app redirect /.well-known/acme-challenge/ to the standard app.
+
+AppEngine terminates TLS so the tls-alpn-01 challenge cannot be used there.
+Apps terminating TLS themselves can set AELE_TLS_ALPN=1 to fall back to it
+when http-01 is not offered, serving its certificate with GetCertificate.
+To validate domains with other challenges, set AELE_CHALLENGE_TYPES to the
+challenge types to use in order of preference, among http-01, dns-01 (see
+wildcard certificates below for its setup) and tls-alpn-01, e.g.
+"dns-01,http-01": the first one the CA offers for a domain is used. Wildcards
+are always validated with dns-01.
+
+Ordering certificates with a specific profile of the CA, such as the
+shortlived profile of Let's Encrypt, is not supported yet by the acme package:
+AELE_ACME_PROFILE is only checked against the profiles offered by the CA,
+failing orders if it is not one of them, and the CA default profile is
+ordered. Certificates valid less than 90 days are updated proportionally
+closer to their expiry.
+
+Apps can call RenewNow to run the cron job from their own code, e.g. from an
+admin page.
+
+Apps managing uploads themselves can call ObtainCertificate directly to
+obtain a certificate for one or more domains. Their key type can be chosen per
+domain with the AELE_KEY_TYPES environment variable, a JSON object such as
+{"example.com": "ecdsa-p256"} (entries starting with a dot match subdomains)
+with values rsa2048 (default), rsa3072, rsa4096, ecdsa-p256 or ecdsa-p384.
+The default RSA key size can be set with AELE_RSA_KEY_BITS (2048, 3072 or
+4096). AppEngine only accepts RSA keys, so other certificates are not ordered
+for it and the cron job fails for domains with ecdsa key types, and it
+historically only accepted up to 2048 bits.
+Certificate requests are signed with the default algorithm of the key type
+(SHA256-RSA or ECDSA-SHA256 for P-256), or the one set with
+AELE_CSR_SIGNATURE_ALGORITHM for CAs or policies requiring another, such as
+SHA384-RSA, SHA256-RSAPSS or ECDSA-SHA384; it must match the key type.
+
+A new key is generated for each certificate by default. For key continuity,
+e.g. to keep a public key pin valid, set AELE_REUSE_KEY=1 to reuse the key of
+a certificate across renewals: it is stored in Datastore per first domain,
+and replaced when its configured key type changes. Fresh keys are preferred
+otherwise: a reused key stays exposed for as long as it is used, and a
+compromised key must be rotated by deleting its AELetsEncryptCertKey entity
+before forcing a renewal.
+
+Certificates are used with the chain the CA returns by default. To prefer an
+alternate chain it offers, set AELE_PREFERRED_CHAIN to the issuer common name
+of its top certificate (e.g. ISRG Root X1). To use the leaf certificate
+without its chain, set AELE_LEAF_ONLY=1.
+
+Certificates without embedded Certificate Transparency SCTs are logged with a
+warning, or refused if AELE_SCT_STRICT=1 is set.
+
+Wildcard certificates
+
+To also cover the wildcard of a custom domain (e.g. example.com and
+*.example.com in one certificate), list it in the comma-separated
+AELE_WILDCARD_DOMAINS environment variable of your app.yaml:
+
+	env_variables:
+	  AELE_WILDCARD_DOMAINS: example.com
+
+Let's Encrypt only validates wildcards with the dns-01 challenge, while the
+domain itself is still validated with http-01 in the same order, so the
+domain must be served by a Cloud DNS managed zone in the app project
+and the AppEngine default service account must have the DNS Administrator
+role (https://console.cloud.google.com/iam-admin/iam/project).
 */
 package aeletsencrypt
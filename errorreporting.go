@@ -0,0 +1,92 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"golang.org/x/oauth2/google"
+	errorreporting "google.golang.org/api/clouderrorreporting/v1beta1"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+// errorReporting is whether failures are reported to Cloud Error Reporting,
+// set with the AELE_ERROR_REPORTING=1 environment variable.
+var errorReporting = os.Getenv("AELE_ERROR_REPORTING") == "1"
+
+// errorTypeRE matches the ACME problem type or Admin API status code of an
+// error, which lose their type when wrapped.
+var errorTypeRE = regexp.MustCompile(`urn:ietf:params:acme:error:\w+|googleapi: Error \d+`)
+
+// reportError reports a failure for a domain (or "" for the run) to Cloud
+// Error Reporting if enabled, so that failures are grouped and can alert.
+// It uses the Cloud Error Reporting API as the AppEngine default service
+// account. Failures to report are only logged.
+func reportError(ctx context.Context, domain string, err error) {
+	if !errorReporting {
+		return
+	}
+	if e := sendErrorReport(ctx, domain, err); e != nil {
+		log.Errorf(ctx, "report error: %v", e)
+	}
+}
+
+func sendErrorReport(ctx context.Context, domain string, err error) error {
+	client, e := google.DefaultClient(ctx, errorreporting.CloudPlatformScope)
+	if e != nil {
+		return fmt.Errorf("default client: %v", e)
+	}
+	svc, e := errorreporting.New(client)
+	if e != nil {
+		return fmt.Errorf("error reporting client: %v", e)
+	}
+	appID := appengine.AppID(ctx)
+	msg := fmt.Sprintf("app=%v", appID)
+	if domain != "" {
+		msg += fmt.Sprintf(" domain=%v", domain)
+	}
+	if t := errorTypeRE.FindString(err.Error()); t != "" {
+		msg += fmt.Sprintf(" type=%q", t)
+	}
+	msg += fmt.Sprintf(": %v", err)
+	event := &errorreporting.ReportedErrorEvent{
+		EventTime: time.Now().UTC().Format(time.RFC3339Nano),
+		Message:   msg,
+		ServiceContext: &errorreporting.ServiceContext{
+			Service: appengine.ModuleName(ctx),
+			Version: appengine.VersionID(ctx),
+		},
+		// Without a stack trace in the message, Error Reporting groups errors
+		// by their report location.
+		Context: &errorreporting.ErrorContext{
+			ReportLocation: &errorreporting.SourceLocation{
+				FilePath:     "github.com/StalkR/aeletsencrypt",
+				FunctionName: errorGroup(domain, err),
+			},
+		},
+	}
+	if _, e := svc.Projects.Events.Report("projects/"+appID, event).Do(); e != nil {
+		return fmt.Errorf("report: %v", e)
+	}
+	return nil
+}
+
+// errorGroup returns the name failures are grouped by in Error Reporting: the
+// domain (or run) and the kind of error, or else its ACME problem type or
+// Admin API status code, so that a failure repeating across runs is one
+// group, distinct from other failures.
+func errorGroup(domain string, err error) string {
+	if domain == "" {
+		domain = "run"
+	}
+	kind := "error"
+	if k := errorKind(err); k != nil {
+		kind = k.Error()
+	} else if t := errorTypeRE.FindString(err.Error()); t != "" {
+		kind = t
+	}
+	return fmt.Sprintf("%v: %v", domain, kind)
+}
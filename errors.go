@@ -0,0 +1,93 @@
+package aeletsencrypt
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"google.golang.org/api/googleapi"
+)
+
+// Kinds of errors of the Admin API and CAs, so that they are told apart by type
+// rather than by their messages, which vary across API versions. Errors of a
+// kind keep the message of the underlying error, and unwrap to their kind for
+// errors.Is.
+var (
+	ErrAPINotEnabled    = errors.New("AppEngine Admin API not enabled")
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrDomainUnverified = errors.New("domain ownership not verified")
+	ErrRateLimited      = errors.New("rate limited")
+	ErrCertificateLimit = errors.New("maximum number of certificates reached")
+)
+
+// kindError is an error of a kind.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the kind of the error.
+func (e *kindError) Unwrap() error {
+	return e.kind
+}
+
+// classify marks err with the kind of its cause, if any, like unavailable.
+func classify(err, cause error) error {
+	if kind := errorKind(cause); kind != nil {
+		return &kindError{kind, err}
+	}
+	return err
+}
+
+// commonKind returns the kind shared by all kinds, or nil if they differ or
+// there are none.
+func commonKind(kinds []error) error {
+	if len(kinds) == 0 {
+		return nil
+	}
+	for _, kind := range kinds[1:] {
+		if kind != kinds[0] {
+			return nil
+		}
+	}
+	return kinds[0]
+}
+
+// errorKind returns the kind of an error of the Admin API or a CA, possibly
+// already classified or marked unavailable, or nil if it has none.
+func errorKind(err error) error {
+	switch e := err.(type) {
+	case *kindError:
+		return e.kind
+	case *unavailableError:
+		return errorKind(e.err)
+	case *acme.Error:
+		if _, ok := acme.RateLimit(e); ok {
+			return ErrRateLimited
+		}
+	case *googleapi.Error:
+		msg := e.Message
+		for _, item := range e.Errors {
+			if item.Reason == "accessNotConfigured" {
+				return ErrAPINotEnabled
+			}
+			msg += " " + item.Message
+		}
+		switch {
+		case strings.Contains(msg, "has not been used"), strings.Contains(msg, "Quota configuration not found"):
+			return ErrAPINotEnabled
+		case strings.Contains(msg, "not authorized to administer this certificate"):
+			return ErrDomainUnverified
+		case certLimitReached(e):
+			return ErrCertificateLimit
+		case e.Code == http.StatusForbidden:
+			return ErrPermissionDenied
+		}
+	}
+	return nil
+}
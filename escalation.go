@@ -0,0 +1,68 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// failuresKind is the Datastore kind of the consecutive failures of a domain,
+// keyed by domain.
+const failuresKind = "AELetsEncryptFailures"
+
+// failures is the Datastore entity of the consecutive failed runs of a domain.
+type failures struct {
+	Count int       `datastore:",noindex"`
+	Since time.Time `datastore:",noindex"` // first failure
+}
+
+// escalateBefore and escalateAfter are when a failing renewal is escalated:
+// within escalateBefore of its certificate expiry, after escalateAfter
+// consecutive failed runs. They default to 7 days and 2 runs and are
+// configurable with the AELE_ESCALATE_DAYS environment variable, from 1 to 30,
+// and AELE_ESCALATE_FAILURES, from 1 to 100.
+var (
+	escalateBefore = time.Duration(envInt("AELE_ESCALATE_DAYS", 7, 1, 30)) * 24 * time.Hour
+	escalateAfter  = envInt("AELE_ESCALATE_FAILURES", 2, 1, 100)
+)
+
+// recordFailure counts a failed run for a domain and returns its number of
+// consecutive failures, this one included.
+func recordFailure(ctx context.Context, domain string) (int, error) {
+	k := datastore.NewKey(ctx, failuresKind, domain, 0, nil)
+	var f failures
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		f = failures{}
+		switch err := datastore.Get(ctx, k, &f); err {
+		case nil:
+		case datastore.ErrNoSuchEntity:
+			f.Since = time.Now()
+		default:
+			return err
+		}
+		f.Count++
+		_, err := datastore.Put(ctx, k, &f)
+		return err
+	}, nil)
+	if err != nil {
+		return 0, fmt.Errorf("datastore: %v", err)
+	}
+	return f.Count, nil
+}
+
+// clearFailures resets the consecutive failures of a domain which succeeded.
+func clearFailures(ctx context.Context, domain string) error {
+	k := datastore.NewKey(ctx, failuresKind, domain, 0, nil)
+	if err := datastore.Delete(ctx, k); err != nil && err != datastore.ErrNoSuchEntity {
+		return fmt.Errorf("datastore delete: %v", err)
+	}
+	return nil
+}
+
+// urgent returns whether a failed renewal of a certificate expiring at
+// expiry, failing for the count consecutive time, is to be escalated.
+func urgent(expiry time.Time, count int) bool {
+	return !expiry.IsZero() && time.Until(expiry) < escalateBefore && count >= escalateAfter
+}
@@ -0,0 +1,33 @@
+package aeletsencrypt
+
+import (
+	"net/http"
+	"os"
+)
+
+// noDefaultHandlers is whether package initialization leaves
+// http.DefaultServeMux alone, for apps calling RegisterHandlers on their own
+// mux instead, set with the AELE_NO_DEFAULT_HANDLERS=1 environment variable.
+var noDefaultHandlers = os.Getenv("AELE_NO_DEFAULT_HANDLERS") == "1"
+
+func init() {
+	if !noDefaultHandlers {
+		RegisterHandlers(http.DefaultServeMux)
+	}
+}
+
+// RegisterHandlers registers the challenge, cron job and admin handlers of the
+// package on mux, the admin handlers under cronPath. Package initialization
+// registers them on http.DefaultServeMux unless AELE_NO_DEFAULT_HANDLERS=1 is
+// set, so apps using their own router can mount a mux with them instead.
+func RegisterHandlers(mux *http.ServeMux) {
+	mux.HandleFunc(challengePrefix, challengeHandler)
+	mux.HandleFunc(cronPath, cronHandler)
+	mux.HandleFunc(cronPath+"/renew", renewHandler)
+	mux.HandleFunc(cronPath+"/preissue", preissueHandler)
+	mux.HandleFunc(cronPath+"/check", checkHandler)
+	mux.HandleFunc(cronPath+"/status", statusHandler)
+	mux.HandleFunc(cronPath+"/history", historyHandler)
+	mux.HandleFunc(cronPath+"/certificates", certificatesHandler)
+	mux.HandleFunc(cronPath+"/metrics", metricsHandler)
+}
@@ -0,0 +1,100 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
+)
+
+// historyKind is the Datastore kind of the issuance history entities.
+const historyKind = "AELetsEncryptHistory"
+
+// historyTTL is how long issuance history is kept.
+// It defaults to 90 days and is configurable in days with the
+// AELE_HISTORY_DAYS environment variable, from 1 to 3650.
+var historyTTL = time.Duration(envInt("AELE_HISTORY_DAYS", 90, 1, 3650)) * 24 * time.Hour
+
+// event is the Datastore entity of a certificate creation or update.
+type event struct {
+	Time    time.Time
+	Domain  string    `datastore:",noindex"`
+	Action  string    `datastore:",noindex"` // created or updated
+	Serial  string    `datastore:",noindex"`
+	Issuer  string    `datastore:",noindex"` // CA common name
+	Expiry  time.Time `datastore:",noindex"`
+	Success bool      `datastore:",noindex"`
+	Error   string    `datastore:",noindex"`
+}
+
+// recordHistory records a certificate creation or update in the history,
+// with the details of the certificate if one was obtained. Failures to
+// record are only logged.
+func recordHistory(ctx context.Context, domain, action, cert string, err error) {
+	e := &event{Time: time.Now(), Domain: domain, Action: action, Success: err == nil}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if chain, err := parseChain(cert); err == nil {
+		leaf := chainPath(chain)[0]
+		e.Serial = fmt.Sprintf("%x", leaf.SerialNumber)
+		e.Issuer = leaf.Issuer.CommonName
+		e.Expiry = leaf.NotAfter
+	}
+	k := datastore.NewIncompleteKey(ctx, historyKind, nil)
+	if _, err := datastore.Put(ctx, k, e); err != nil {
+		log.Errorf(ctx, "domain=%v: record history: %v", domain, err)
+	}
+}
+
+// pruneHistory deletes history older than historyTTL.
+func pruneHistory(ctx context.Context) error {
+	q := datastore.NewQuery(historyKind).Filter("Time <", time.Now().Add(-historyTTL)).KeysOnly()
+	keys, err := q.GetAll(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("datastore query: %v", err)
+	}
+	if err := datastore.DeleteMulti(ctx, keys); err != nil {
+		return fmt.Errorf("datastore delete: %v", err)
+	}
+	return nil
+}
+
+// historyHandler renders the last events of the history, 50 or the n
+// parameter, most recent first.
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	if !user.IsAdmin(ctx) {
+		http.Error(w, "unauthorized", http.StatusForbidden)
+		return
+	}
+	n := 50
+	if v := r.FormValue("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 1 || n > 1000 {
+			http.Error(w, "invalid n, must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+	}
+	var events []event
+	if _, err := datastore.NewQuery(historyKind).Order("-Time").Limit(n).GetAll(ctx, &events); err != nil {
+		http.Error(w, fmt.Sprintf("datastore query: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "Last %v events:\n", len(events))
+	for _, e := range events {
+		if !e.Success {
+			fmt.Fprintf(w, " - %v %v: %v failed: %v\n", e.Time.UTC().Format(time.RFC3339), e.Domain, e.Action, e.Error)
+			continue
+		}
+		fmt.Fprintf(w, " - %v %v: %v, serial %v, issued by %v, expires on %v\n",
+			e.Time.UTC().Format(time.RFC3339), e.Domain, e.Action, e.Serial, e.Issuer, e.Expiry.UTC().Format(time.RFC3339))
+	}
+}
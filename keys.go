@@ -0,0 +1,225 @@
+package aeletsencrypt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+)
+
+// defaultKeyType is the certificate key type used unless configured otherwise
+// per domain: RSA 2048 by default, with a size configurable with the
+// AELE_RSA_KEY_BITS environment variable, 2048, 3072 or 4096.
+// The account key remains RSA 2048.
+var defaultKeyType = rsaKeyType("AELE_RSA_KEY_BITS")
+
+// rsaKeyType reads an RSA key size from an environment variable and returns
+// its key type, recording invalid values in configErr.
+func rsaKeyType(name string) string {
+	switch bits := envInt(name, 2048, 2048, 4096); bits {
+	case 2048, 3072, 4096:
+		return fmt.Sprintf("rsa%v", bits)
+	default:
+		if configErr == nil {
+			configErr = fmt.Errorf("invalid %v=%v: must be 2048, 3072 or 4096", name, bits)
+		}
+		return "rsa2048"
+	}
+}
+
+// keyTypes are the certificate key types by domain, read from the
+// AELE_KEY_TYPES environment variable as a JSON object such as
+// {"example.com": "rsa4096", ".internal.example.com": "ecdsa-p256"}.
+// Keys starting with a dot match subdomains. Values are keyTypeNames.
+// AppEngine only accepts RSA keys, so ecdsa key types are for apps calling
+// ObtainCertificate themselves: the cron job fails to create or update the
+// certificates of domains configured with them.
+var keyTypes = envKeyTypes("AELE_KEY_TYPES")
+
+// keyTypeNames are the key types of newKey.
+var keyTypeNames = []string{"rsa2048", "rsa3072", "rsa4096", "ecdsa-p256", "ecdsa-p384"}
+
+// envKeyTypes reads key types by domain from an environment variable,
+// recording invalid values in configErr. Keys are only generated when used.
+func envKeyTypes(name string) map[string]string {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	var types map[string]string
+	err := json.Unmarshal([]byte(v), &types)
+	for domain, t := range types {
+		if err != nil {
+			break
+		}
+		if !knownKeyType(t) {
+			err = fmt.Errorf("%v: unknown key type %q, must be one of %v", domain, t, strings.Join(keyTypeNames, ", "))
+		}
+	}
+	if err != nil {
+		if configErr == nil {
+			configErr = fmt.Errorf("invalid %v: %v", name, err)
+		}
+		return nil
+	}
+	return types
+}
+
+// knownKeyType returns whether a key type is one of keyTypeNames.
+func knownKeyType(keyType string) bool {
+	for _, t := range keyTypeNames {
+		if t == keyType {
+			return true
+		}
+	}
+	return false
+}
+
+// keyTypeFor returns the configured key type of a certificate for a domain:
+// of the domain itself, or else of its longest matching suffix, or else
+// defaultKeyType.
+func keyTypeFor(domain string) string {
+	domain = strings.ToLower(strings.TrimPrefix(domain, "*."))
+	match, keyType := "", defaultKeyType
+	for pattern, t := range keyTypes {
+		pattern = strings.ToLower(pattern)
+		if pattern == domain {
+			return t
+		}
+		if strings.HasPrefix(pattern, ".") && strings.HasSuffix(domain, pattern) && len(pattern) > len(match) {
+			match, keyType = pattern, t
+		}
+	}
+	return keyType
+}
+
+// newKey generates a private key of a key type: rsa2048, rsa3072, rsa4096,
+// ecdsa-p256 or ecdsa-p384.
+func newKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case "rsa2048":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "rsa3072":
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case "rsa4096":
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case "ecdsa-p256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ecdsa-p384":
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	}
+	return nil, fmt.Errorf("unknown key type %q", keyType)
+}
+
+// checkAppEngineKeyType returns an error if AppEngine does not accept
+// certificates with keys of a key type.
+// "Private keys must use RSA encryption."
+// https://cloud.google.com/appengine/docs/standard/python/using-custom-domains-and-ssl#app_engine_support_for_ssl_certificates
+func checkAppEngineKeyType(keyType string) error {
+	if !strings.HasPrefix(keyType, "rsa") {
+		return fmt.Errorf("key type %v not supported by AppEngine, which only accepts RSA keys", keyType)
+	}
+	return nil
+}
+
+// keySizeTip explains an upload error for a certificate with a key larger
+// than AppEngine historically accepted, when the Admin API rejected the
+// upload, cause, as an invalid argument about its key or certificate.
+// "Maximum allowed key modulus: 2048 bits"
+func keySizeTip(err, cause error, keyType string) error {
+	if keyType == "rsa2048" || !invalidCertificate(cause) {
+		return err
+	}
+	return fmt.Errorf("%v\nTip: AppEngine may not accept %v keys, "+
+		"set AELE_RSA_KEY_BITS (or AELE_KEY_TYPES) to 2048 bits", err, keyType)
+}
+
+// invalidCertificate returns whether an Admin API error is an invalid
+// argument (400) error about the key or certificate uploaded.
+func invalidCertificate(err error) bool {
+	e, ok := err.(*googleapi.Error)
+	if !ok || e.Code != http.StatusBadRequest {
+		return false
+	}
+	msg := strings.ToLower(e.Message)
+	return strings.Contains(msg, "key") || strings.Contains(msg, "certificate")
+}
+
+// csrSignatureAlgorithm is the signature algorithm of certificate requests,
+// read from the AELE_CSR_SIGNATURE_ALGORITHM environment variable as named by
+// x509.SignatureAlgorithm (e.g. SHA384-RSA or ECDSA-SHA256). It defaults to
+// the default of the key type.
+var csrSignatureAlgorithm = envSignatureAlgorithm("AELE_CSR_SIGNATURE_ALGORITHM")
+
+// signatureAlgorithms are the supported CSR signature algorithms.
+var signatureAlgorithms = []x509.SignatureAlgorithm{
+	x509.SHA256WithRSA, x509.SHA384WithRSA, x509.SHA512WithRSA,
+	x509.SHA256WithRSAPSS, x509.SHA384WithRSAPSS, x509.SHA512WithRSAPSS,
+	x509.ECDSAWithSHA256, x509.ECDSAWithSHA384, x509.ECDSAWithSHA512,
+}
+
+// envSignatureAlgorithm reads a signature algorithm from an environment
+// variable, recording invalid values in configErr.
+func envSignatureAlgorithm(name string) x509.SignatureAlgorithm {
+	v := os.Getenv(name)
+	if v == "" {
+		return x509.UnknownSignatureAlgorithm
+	}
+	var names []string
+	for _, a := range signatureAlgorithms {
+		if strings.EqualFold(a.String(), v) {
+			return a
+		}
+		names = append(names, a.String())
+	}
+	if configErr == nil {
+		configErr = fmt.Errorf("invalid %v=%q: must be one of %v", name, v, strings.Join(names, ", "))
+	}
+	return x509.UnknownSignatureAlgorithm
+}
+
+// checkSignatureAlgorithm returns an error if a signature algorithm cannot
+// sign with a key.
+func checkSignatureAlgorithm(alg x509.SignatureAlgorithm, key crypto.Signer) error {
+	if alg == x509.UnknownSignatureAlgorithm {
+		return nil
+	}
+	name := alg.String()
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		if strings.HasSuffix(name, "-RSA") || strings.HasSuffix(name, "-RSAPSS") {
+			return nil
+		}
+	case *ecdsa.PrivateKey:
+		if strings.HasPrefix(name, "ECDSA-") {
+			return nil
+		}
+	}
+	return fmt.Errorf("CSR signature algorithm %v (AELE_CSR_SIGNATURE_ALGORITHM) cannot sign with %T keys, "+
+		"check AELE_KEY_TYPES", alg, key)
+}
+
+// encodeKey PEM encodes a private key generated by newKey.
+func encodeKey(key crypto.Signer) ([]byte, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}), nil
+	case *ecdsa.PrivateKey:
+		b, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), nil
+	}
+	return nil, fmt.Errorf("unsupported key %T", key)
+}
@@ -0,0 +1,85 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/cloudkms/v1"
+)
+
+// accountKMSKey is the Cloud KMS key version holding the ACME account key,
+// such as projects/<project>/locations/global/keyRings/<ring>/cryptoKeys/<key>/cryptoKeyVersions/1,
+// read from the AELE_ACCOUNT_KMS_KEY environment variable. It must be an
+// RSA PKCS#1 SHA-256 signing key, and the AppEngine default service account
+// needs the Cloud KMS CryptoKey Signer/Verifier role on it. Certificate keys
+// cannot be held in KMS since AppEngine needs them to serve certificates.
+var accountKMSKey = os.Getenv("AELE_ACCOUNT_KMS_KEY")
+
+// kmsSigner is a crypto.Signer signing with a Cloud KMS key version, so that
+// the key never leaves KMS.
+type kmsSigner struct {
+	ctx  context.Context
+	svc  *cloudkms.Service
+	name string
+	pub  crypto.PublicKey
+}
+
+// newKMSSigner returns a signer for a Cloud KMS key version, used with the
+// AppEngine default service account.
+func newKMSSigner(ctx context.Context, name string) (*kmsSigner, error) {
+	client, err := google.DefaultClient(ctx, cloudkms.CloudkmsScope)
+	if err != nil {
+		return nil, fmt.Errorf("default client: %v", err)
+	}
+	svc, err := cloudkms.New(retryClient(client))
+	if err != nil {
+		return nil, fmt.Errorf("cloudkms: %v", err)
+	}
+	pk, err := svc.Projects.Locations.KeyRings.CryptoKeys.CryptoKeyVersions.GetPublicKey(name).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("kms get public key: %v", err)
+	}
+	if !strings.HasPrefix(pk.Algorithm, "RSA_SIGN_PKCS1_") || !strings.HasSuffix(pk.Algorithm, "_SHA256") {
+		return nil, fmt.Errorf("kms key %v is %v, want an RSA PKCS#1 SHA-256 signing key", name, pk.Algorithm)
+	}
+	block, _ := pem.Decode([]byte(pk.Pem))
+	if block == nil {
+		return nil, fmt.Errorf("kms public key: no PEM data")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("kms public key: %v", err)
+	}
+	if _, ok := pub.(*rsa.PublicKey); !ok {
+		return nil, fmt.Errorf("kms public key: unsupported key %T", pub)
+	}
+	return &kmsSigner{ctx: ctx, svc: svc, name: name, pub: pub}, nil
+}
+
+// Public implements crypto.Signer.
+func (s *kmsSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+// Sign implements crypto.Signer for SHA-256 digests.
+func (s *kmsSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, fmt.Errorf("kms sign: unsupported hash %v", opts.HashFunc())
+	}
+	res, err := s.svc.Projects.Locations.KeyRings.CryptoKeys.CryptoKeyVersions.AsymmetricSign(s.name, &cloudkms.AsymmetricSignRequest{
+		Digest: &cloudkms.Digest{Sha256: base64.StdEncoding.EncodeToString(digest)},
+	}).Context(s.ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("kms sign: %v", err)
+	}
+	return base64.StdEncoding.DecodeString(res.Signature)
+}
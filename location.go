@@ -0,0 +1,38 @@
+package aeletsencrypt
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// appLocation is the AppEngine location (region) of the managed apps, e.g.
+// us-central or europe-west, read from the AELE_LOCATION environment
+// variable. By default, the location of apps is not checked.
+var appLocation = os.Getenv("AELE_LOCATION")
+
+// appLocations caches the location of apps by app ID, since it cannot change.
+var appLocations sync.Map
+
+// checkLocation returns an error if appLocation is set and an app is in
+// another location, as reported by the Admin API, so that the custom domains
+// of an app other than intended (e.g. a project recreated in another region)
+// are not managed.
+func checkLocation(svc admin, appID string) error {
+	if appLocation == "" {
+		return nil
+	}
+	loc, ok := appLocations.Load(appID)
+	if !ok {
+		app, err := svc.GetApp(appID)
+		if err != nil {
+			return classify(fmt.Errorf("get app: %v", err), err)
+		}
+		loc = app.LocationId
+		appLocations.Store(appID, loc)
+	}
+	if loc != appLocation {
+		return fmt.Errorf("app %v is in location %v, not AELE_LOCATION %v", appID, loc, appLocation)
+	}
+	return nil
+}
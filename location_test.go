@@ -0,0 +1,32 @@
+package aeletsencrypt
+
+import "testing"
+
+func TestCheckLocation(t *testing.T) {
+	svc := newFakeAdmin(t, nil, nil)
+	restore := appLocation
+	defer func() { appLocation = restore }()
+
+	appLocation = ""
+	if err := checkLocation(svc, "unchecked-app"); err != nil {
+		t.Errorf("checkLocation without AELE_LOCATION: %v", err)
+	}
+	if svc.getApps != 0 {
+		t.Errorf("got %v GetApp calls without AELE_LOCATION, want none", svc.getApps)
+	}
+
+	appLocation = "us-central"
+	for i := 0; i < 2; i++ {
+		if err := checkLocation(svc, "test-location-app"); err != nil {
+			t.Errorf("checkLocation: %v", err)
+		}
+	}
+	if svc.getApps != 1 {
+		t.Errorf("got %v GetApp calls, want 1 with the location cached", svc.getApps)
+	}
+
+	appLocation = "europe-west"
+	if err := checkLocation(svc, "test-location-app"); err == nil {
+		t.Errorf("checkLocation in another location: got nil error")
+	}
+}
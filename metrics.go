@@ -0,0 +1,39 @@
+package aeletsencrypt
+
+import (
+	"fmt"
+	"net/http"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/user"
+)
+
+// metricsHandler exports the time of the last run and the leaf expiry of
+// the certificate of each domain it saw, in OpenMetrics text format, so that
+// operators can alert on aele_cert_expiry_seconds - time() < threshold.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	if !user.IsAdmin(ctx) {
+		http.Error(w, "unauthorized", http.StatusForbidden)
+		return
+	}
+	s, err := loadStatus(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	if s != nil {
+		fmt.Fprintln(w, "# TYPE aele_last_run_timestamp_seconds gauge")
+		fmt.Fprintln(w, "# HELP aele_last_run_timestamp_seconds Time the last run started.")
+		fmt.Fprintf(w, "aele_last_run_timestamp_seconds %v\n", s.Time.Unix())
+		fmt.Fprintln(w, "# TYPE aele_cert_expiry_seconds gauge")
+		fmt.Fprintln(w, "# HELP aele_cert_expiry_seconds Expiry of the leaf certificate of a domain.")
+		for i, domain := range s.ExpiryDomains {
+			if i < len(s.ExpiryTimes) {
+				fmt.Fprintf(w, "aele_cert_expiry_seconds{domain=%q} %v\n", domain, s.ExpiryTimes[i].Unix())
+			}
+		}
+	}
+	fmt.Fprintln(w, "# EOF")
+}
@@ -0,0 +1,48 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/mail"
+)
+
+// notifyEmail is the address to email a summary of runs creating or updating
+// certificates or failing, read from the AELE_NOTIFY_EMAIL environment variable.
+var notifyEmail = os.Getenv("AELE_NOTIFY_EMAIL")
+
+// notify emails a summary of a run to notifyEmail, if set and if anything
+// happened, marked urgent if renewals failing close to expiry were escalated.
+// Failing to send is logged but does not fail the run.
+func notify(ctx context.Context, succeeded, critical []string, err error) {
+	if notifyEmail == "" || len(succeeded) == 0 && err == nil {
+		return
+	}
+	appID := appengine.AppID(ctx)
+	subject := fmt.Sprintf("aeletsencrypt: %v: %v succeeded", appID, len(succeeded))
+	var body strings.Builder
+	if len(critical) > 0 {
+		subject = fmt.Sprintf("URGENT: %v, %v certificates about to expire", subject, len(critical))
+		fmt.Fprintf(&body, "Certificates about to expire whose renewal keeps failing:\n - %v\n\n",
+			strings.Join(critical, "\n - "))
+	}
+	if len(succeeded) > 0 {
+		fmt.Fprintf(&body, "Succeeded:\n - %v\n\n", strings.Join(succeeded, "\n - "))
+	}
+	if err != nil {
+		subject += ", failed"
+		fmt.Fprintf(&body, "Error: %v\n", err)
+	}
+	if err := mail.Send(ctx, &mail.Message{
+		Sender:  fmt.Sprintf("aeletsencrypt@%v.appspotmail.com", appID),
+		To:      []string{notifyEmail},
+		Subject: subject,
+		Body:    body.String(),
+	}); err != nil {
+		log.Errorf(ctx, "notify %v: %v", notifyEmail, err)
+	}
+}
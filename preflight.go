@@ -0,0 +1,202 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+// pingPath is served by the challenge handler with the app ID, so that
+// preflight can check requests for a domain reach this app.
+const pingPath = challengePath + "ping"
+
+// serviceHeader is the header of ping responses naming the service which
+// served them.
+const serviceHeader = "X-Aeletsencrypt-Service"
+
+// challengeService is the service all domains are expected to route
+// challenges to, read from the AELE_CHALLENGE_SERVICE environment variable.
+// Any service importing this package serves challenges, so domains routed to
+// another one are only warned about.
+var challengeService = os.Getenv("AELE_CHALLENGE_SERVICE")
+
+// skipPreflight disables preflight, set with the AELE_SKIP_PREFLIGHT=1
+// environment variable.
+var skipPreflight = os.Getenv("AELE_SKIP_PREFLIGHT") == "1"
+
+// selfTestOnce runs selfTest once per instance.
+var selfTestOnce sync.Once
+
+// selfTest checks once that the challenge handler is reachable over http on
+// port 80, where CAs validate http-01, at the app default hostname, warning
+// if another handler appears to shadow it, e.g. registered or listed in
+// app.yaml before it.
+func selfTest(ctx context.Context) {
+	selfTestOnce.Do(func() {
+		url := "http://" + appengine.DefaultVersionHostname(ctx) + pingPath
+		res, err := validationClient(ctx).Get(url)
+		if err != nil {
+			log.Warningf(ctx, "self-test: %v: %v", url, err)
+			return
+		}
+		b, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			log.Warningf(ctx, "self-test: %v: %v", url, err)
+			return
+		}
+		if string(b) != appengine.AppID(ctx) {
+			log.Warningf(ctx, "self-test: %v responded %v without the app ID, another handler appears to "+
+				"shadow the challenge handler: check handlers order in app.yaml and the app", url, res.Status)
+		}
+	})
+}
+
+// propagationRetries is how many more times preflight checks a domain not
+// reaching this app yet, e.g. a domain just added whose DNS has not
+// propagated, waiting propagationDelay before each. They default to 2 and 30
+// seconds and are configurable with the AELE_PROPAGATION_RETRIES environment
+// variable, from 0 to 10, and AELE_PROPAGATION_DELAY_SECONDS, from 1 to 300.
+var (
+	propagationRetries = envInt("AELE_PROPAGATION_RETRIES", 2, 0, 10)
+	propagationDelay   = time.Duration(envInt("AELE_PROPAGATION_DELAY_SECONDS", 30, 1, 300)) * time.Second
+)
+
+// propagationError is the error of a certificate not ordered because one of
+// its domains does not reach this app yet, skipped until the next run rather
+// than failed.
+type propagationError struct {
+	err error
+}
+
+func (e *propagationError) Error() string {
+	return fmt.Sprintf("preflight: %v, skipping until the next run", e.err)
+}
+
+// preflight checks that http requests for the domains validated over http
+// reach this app before ordering a certificate for them, rather than
+// consuming a failed authorization, e.g. when DNS has not propagated yet.
+// Domains not reaching it are checked again propagationRetries times, and
+// a propagationError returned if they still do not. It is skipped when
+// http-01 is not the preferred challenge type.
+func preflight(ctx context.Context, domains []string) error {
+	if skipPreflight || challengeTypes[0] != "http-01" {
+		return nil
+	}
+	appID := appengine.AppID(ctx)
+	client := validationClient(ctx)
+	for _, domain := range domains {
+		if strings.HasPrefix(domain, "*.") {
+			continue // validated over dns
+		}
+		host, err := asciiDomain(domain)
+		if err != nil {
+			return fmt.Errorf("preflight: %v", err)
+		}
+		for n := 0; ; n++ {
+			service, err := reachesApp(client, appID, domain, host)
+			if err == nil {
+				if challengeService != "" && service != challengeService {
+					log.Warningf(ctx, "preflight: %v routes challenges to service %v, not %v (AELE_CHALLENGE_SERVICE), "+
+						"check dispatch.yaml", domain, service, challengeService)
+				}
+				break
+			}
+			if n >= propagationRetries {
+				return &propagationError{err}
+			}
+			log.Infof(ctx, "preflight: %v, retrying in %v", err, propagationDelay)
+			if err := sleep(ctx, propagationDelay); err != nil {
+				return fmt.Errorf("preflight: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// reachesApp returns an error unless http requests for a domain (with its
+// ASCII host) reach the app, and else the service they are routed to.
+func reachesApp(client *http.Client, appID, domain, host string) (string, error) {
+	url := "http://" + host + pingPath
+	res, err := client.Get(url)
+	if err != nil {
+		return "", fmt.Errorf("%v does not reach this app: %v", domain, err)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return "", fmt.Errorf("%v does not reach this app: %v", domain, err)
+	}
+	if string(b) != appID {
+		return "", fmt.Errorf("%v does not reach this app: %v responded %v, "+
+			"check its DNS points to AppEngine and dispatch.yaml routes the challenge handler "+
+			"to a service of this app importing this package", domain, url, res.Status)
+	}
+	return res.Header.Get(serviceHeader), nil
+}
+
+// challengeRoute returns the service challenges for a domain are routed to.
+func challengeRoute(ctx context.Context, domain string) (string, error) {
+	host, err := asciiDomain(domain)
+	if err != nil {
+		return "", err
+	}
+	return reachesApp(validationClient(ctx), appengine.AppID(ctx), domain, host)
+}
+
+// servedChallenge checks that the http-01 challenge response saved for a
+// domain is served at its path, saving it again if not, e.g. when memcache
+// evicted it before it reached Datastore, so that the CA is only asked to
+// validate once it can. It is skipped along with preflight.
+func servedChallenge(ctx context.Context, domain, path, response string) error {
+	if skipPreflight {
+		return nil
+	}
+	for n := 1; ; n++ {
+		err := fetchChallenge(ctx, domain, path, response)
+		if err == nil {
+			return nil
+		}
+		if n >= maxAttempts {
+			return fmt.Errorf("challenge self-check: %v", err)
+		}
+		if err := sleep(ctx, backoff(n)); err != nil {
+			return fmt.Errorf("challenge self-check: %v", err)
+		}
+		if err := putChallenge(ctx, path, response); err != nil {
+			return err
+		}
+	}
+}
+
+// fetchChallenge fetches a challenge path on a domain like a CA and returns
+// an error unless it serves the response.
+func fetchChallenge(ctx context.Context, domain, path, response string) error {
+	host, err := asciiDomain(domain)
+	if err != nil {
+		return err
+	}
+	url := "http://" + host + path
+	res, err := validationClient(ctx).Get(url)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK || string(b) != response {
+		return fmt.Errorf("%v responded %v, not the challenge response, "+
+			"check its DNS points to AppEngine and handlers order", url, res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package aeletsencrypt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidationClientRedirectedToHTTPS(t *testing.T) {
+	// Like AppEngine with "secure: always", on a domain without a valid
+	// certificate yet: the test server certificate is not trusted.
+	https := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "response")
+	}))
+	defer https.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, https.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer srv.Close()
+
+	ctx, _ := newTestContext(t)
+	res, err := validationClient(ctx).Get(srv.URL + challengePath + "token")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if res.StatusCode != http.StatusOK || string(b) != "response" {
+		t.Errorf("got %v %q, want 200 OK %q", res.Status, b, "response")
+	}
+}
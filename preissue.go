@@ -0,0 +1,77 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/user"
+)
+
+// preissuedSuffix ends the display name of pre-issued certificates, so that
+// they are not deleted as orphans before their domain is mapped.
+const preissuedSuffix = " (pre-issued)"
+
+// preissueHandler creates a certificate for a domain about to be added as a
+// custom domain.
+func preissueHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	if !user.IsAdmin(ctx) {
+		http.Error(w, "unauthorized", http.StatusForbidden)
+		return
+	}
+	domain := r.FormValue("domain")
+	if domain == "" {
+		http.Error(w, "missing domain", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	if err := preissue(ctx, w, domain); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+	}
+}
+
+// preissue obtains a certificate for a domain not yet mapped to the app and
+// creates it without mapping it, so that the next run binds it as soon as the
+// domain is added as a custom domain (see bind) rather than ordering one then.
+// The domain must already reach the app for the http-01 challenge, e.g. with
+// a dispatch from another domain, otherwise dns-01 must be preferred.
+func preissue(ctx context.Context, w io.Writer, domain string) (err error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if strings.HasPrefix(domain, "*.") || !strings.Contains(domain, ".") {
+		return fmt.Errorf("invalid domain %v: want a custom domain such as www.example.com", domain)
+	}
+	if _, err := asciiDomain(domain); err != nil {
+		return err
+	}
+	if reason := unmanaged(domain); reason != "" {
+		return fmt.Errorf("%v: %v", domain, reason)
+	}
+	appID := appengine.AppID(ctx)
+	svc, err := newAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = svc.GetDomainMapping(appID, domain)
+	if err == nil {
+		return fmt.Errorf("%v is already a custom domain, renew it instead", domain)
+	}
+	if e, ok := err.(*googleapi.Error); !ok || e.Code != http.StatusNotFound {
+		return addTip(ctx, classify(fmt.Errorf("get domain %v: %v", domain, err), err))
+	}
+
+	var cert string
+	defer func() { recordHistory(ctx, domain, "created", cert, err) }()
+	fmt.Fprintf(w, "%v: not a custom domain yet, creating certificate\n", domain)
+	created, cert, err := uploadCert(ctx, svc, appID, domain, displayName(domain)+preissuedSuffix, certDomains(domain))
+	if err != nil {
+		return fmt.Errorf("%v: %v", domain, err)
+	}
+	fmt.Fprintf(w, "%v: created certificate %v expiring on %v, it will be bound once the domain is added\n",
+		domain, created.Id, notAfter(cert).UTC().Format("2006-01-02"))
+	return nil
+}
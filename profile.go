@@ -0,0 +1,63 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"google.golang.org/appengine/log"
+)
+
+// acmeProfile is the ACME certificate profile to order (e.g. shortlived for
+// Let's Encrypt certificates valid 6 days), read from the AELE_ACME_PROFILE
+// environment variable. It must be offered by the CA, but the acme package
+// cannot order profiles yet, so the CA default profile is ordered instead.
+var acmeProfile = os.Getenv("AELE_ACME_PROFILE")
+
+// checkProfile returns an error if acmeProfile is set but not among the
+// profiles the CA offers in its directory metadata. The directory is fetched
+// again since acme.Directory does not expose them.
+func checkProfile(ctx context.Context, client *acme.Client) error {
+	if acmeProfile == "" {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", client.DirectoryURL, nil)
+	if err != nil {
+		return fmt.Errorf("profile: %v", err)
+	}
+	req.Header.Set("User-Agent", client.UserAgent)
+	resp, err := client.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("profile: directory: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("profile: directory: %v", resp.Status)
+	}
+	var dir struct {
+		Meta struct {
+			Profiles map[string]string `json:"profiles"`
+		} `json:"meta"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&dir); err != nil {
+		return fmt.Errorf("profile: directory: %v", err)
+	}
+	if _, ok := dir.Meta.Profiles[acmeProfile]; !ok {
+		var names []string
+		for name := range dir.Meta.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if len(names) == 0 {
+			return fmt.Errorf("invalid AELE_ACME_PROFILE=%q: CA %v offers no profiles", acmeProfile, client.DirectoryURL)
+		}
+		return fmt.Errorf("invalid AELE_ACME_PROFILE=%q: CA %v offers %v", acmeProfile, client.DirectoryURL, strings.Join(names, ", "))
+	}
+	log.Warningf(ctx, "ordering profile %v is not supported yet, ordering the CA default profile", acmeProfile)
+	return nil
+}
@@ -0,0 +1,96 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/appengine"
+)
+
+// Directory endpoints of Google Public CA production and staging environments.
+const (
+	googleURL        = "https://dv.acme-v02.api.pki.goog/directory"
+	googleStagingURL = "https://dv.acme-v02.test-api.pki.goog/directory"
+)
+
+// googleCA is whether certificates are ordered from Google Public CA instead
+// of Let's Encrypt, set with the AELE_ACME_CA=google environment variable.
+var googleCA = envCA("AELE_ACME_CA")
+
+// envCA reads whether Google Public CA is selected from an environment
+// variable, google or letsencrypt, recording invalid values in configErr.
+func envCA(name string) bool {
+	switch v := os.Getenv(name); v {
+	case "", "letsencrypt":
+		return false
+	case "google":
+		return true
+	default:
+		if configErr == nil {
+			configErr = fmt.Errorf("invalid %v=%q: must be letsencrypt or google", name, v)
+		}
+		return false
+	}
+}
+
+// accountBinding returns the External Account Binding to register with a CA:
+// from configuration if set, or else for Google Public CA, new credentials
+// from its API.
+func accountBinding(ctx context.Context, ca ca) (*acme.ExternalAccountBinding, error) {
+	eab, err := externalAccountBinding(ca.envPrefix)
+	if eab != nil || err != nil {
+		return eab, err
+	}
+	if ca.directory != googleURL && ca.directory != googleStagingURL {
+		return nil, nil
+	}
+	return googleAccountBinding(ctx)
+}
+
+// googleAccountBinding creates External Account Binding credentials for
+// Google Public CA with its API as the AppEngine default service account,
+// which needs the Public CA External Account Key Creator role.
+func googleAccountBinding(ctx context.Context) (*acme.ExternalAccountBinding, error) {
+	client, err := google.DefaultClient(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		return nil, fmt.Errorf("default client: %v", err)
+	}
+	url := fmt.Sprintf("https://publicca.googleapis.com/v1/projects/%v/locations/global/externalAccountKeys",
+		appengine.AppID(ctx))
+	req, err := http.NewRequest("POST", url, strings.NewReader("{}"))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("create external account key: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(res.Body)
+		return nil, fmt.Errorf("create external account key: %v: %s\n"+
+			"Tip: enable Public Certificate Authority API and add AppEngine default service account "+
+			"to role Public CA External Account Key Creator", res.Status, b)
+	}
+	var key struct {
+		KeyID     string `json:"keyId"`
+		B64MacKey string `json:"b64MacKey"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&key); err != nil {
+		return nil, fmt.Errorf("decode external account key: %v", err)
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(key.B64MacKey, "="))
+	if err != nil {
+		return nil, fmt.Errorf("decode external account key: %v", err)
+	}
+	return &acme.ExternalAccountBinding{KID: key.KeyID, Key: mac}, nil
+}
@@ -0,0 +1,73 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/user"
+)
+
+// renewHandler creates or updates the certificate of one custom domain
+// immediately, regardless of its expiry.
+func renewHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	if !user.IsAdmin(ctx) {
+		http.Error(w, "unauthorized", http.StatusForbidden)
+		return
+	}
+	domain := r.FormValue("domain")
+	if domain == "" {
+		http.Error(w, "missing domain", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	if err := renew(ctx, w, domain); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+	}
+}
+
+// renew creates the certificate of a custom domain if it has none,
+// or else updates its current certificate.
+func renew(ctx context.Context, w io.Writer, domain string) error {
+	if reason := unmanaged(domain); reason != "" {
+		return fmt.Errorf("%v: %v", domain, reason)
+	}
+	appID := appengine.AppID(ctx)
+	svc, err := newAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	mapping, err := svc.GetDomainMapping(appID, domain)
+	if err != nil {
+		return addTip(ctx, classify(fmt.Errorf("get domain %v: %v", domain, err), err))
+	}
+
+	if mapping.SslSettings != nil && mapping.SslSettings.SslManagementType == "AUTOMATIC" {
+		return fmt.Errorf("%v: certificate managed by AppEngine", domain)
+	}
+	if mapping.SslSettings == nil || mapping.SslSettings.CertificateId == "" {
+		fmt.Fprintf(w, "%v: no certificate, creating\n", domain)
+		if _, err := createCert(ctx, svc, appID, domain, []string{domain}); err != nil {
+			return classify(fmt.Errorf("%v: %v", domain, err), err)
+		}
+		fmt.Fprintf(w, "%v: created\n", domain)
+		return nil
+	}
+
+	c, err := svc.GetCertificate(appID, mapping.SslSettings.CertificateId)
+	if err != nil {
+		return addTip(ctx, classify(fmt.Errorf("get cert for %v: %v", domain, err), err))
+	}
+	if !marked(c) {
+		return fmt.Errorf("%v: certificate %q not managed by aeletsencrypt", domain, c.DisplayName)
+	}
+	fmt.Fprintf(w, "%v: certificate expires on %v, updating\n", domain, c.ExpireTime)
+	if _, err := updateCert(ctx, svc, appID, c); err != nil {
+		return classify(fmt.Errorf("%v: %v", domain, err), err)
+	}
+	fmt.Fprintf(w, "%v: updated\n", domain)
+	return nil
+}
@@ -0,0 +1,104 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// maxAttempts is the number of attempts for requests failing transiently.
+const maxAttempts = 3
+
+// backoff is the exponential delay before retry n, starting at 1.
+func backoff(n int) time.Duration {
+	return time.Duration(1<<uint(n-1)) * time.Second
+}
+
+// retryBackoff is the acme.Client RetryBackoff: the ACME client already
+// retries server errors, this bounds it to maxAttempts and does not retry
+// rate limits, which will not be lifted during this run.
+func retryBackoff(n int, r *http.Request, res *http.Response) time.Duration {
+	if n >= maxAttempts || res.StatusCode == http.StatusTooManyRequests {
+		return -1
+	}
+	return backoff(n)
+}
+
+// retryClient returns a copy of client retrying idempotent requests failing
+// transiently, used for the AppEngine Admin API.
+func retryClient(client *http.Client) *http.Client {
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	c := *client
+	c.Transport = &retryTransport{base: base}
+	return &c
+}
+
+// retryTransport retries idempotent requests failing with a timeout or
+// server error with exponential backoff. Other requests, such as POST creating
+// certificates, are not retried: they may have succeeded despite the error,
+// and retrying would create duplicates.
+type retryTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for n := 1; ; n++ {
+		res, err := t.base.RoundTrip(req)
+		rewindable := req.Body == nil || req.GetBody != nil
+		if n >= maxAttempts || !idempotent[req.Method] || !rewindable || !retriable(res, err) {
+			return res, err
+		}
+		if res != nil {
+			res.Body.Close()
+		}
+		if req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r := *req
+			r.Body = body
+			req = &r
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(backoff(n)):
+		}
+	}
+}
+
+// idempotent are the methods of requests retried by retryTransport, which
+// have the same effect whether done once or more.
+var idempotent = map[string]bool{
+	http.MethodGet:    true,
+	http.MethodHead:   true,
+	http.MethodPatch:  true,
+	http.MethodDelete: true,
+}
+
+// retriable returns whether a request failed transiently: a network timeout
+// or a server error.
+func retriable(res *http.Response, err error) bool {
+	if err != nil {
+		e, ok := err.(net.Error)
+		return ok && e.Timeout()
+	}
+	return res.StatusCode >= 500
+}
+
+// sleep waits for a duration, returning early with the context error if it
+// is canceled.
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
@@ -0,0 +1,61 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// retryAfterKind is the Datastore kind of the rate limit entity of a domain,
+// keyed by domain.
+const retryAfterKind = "AELetsEncryptRetryAfter"
+
+// retryAfter is the Datastore entity of when a domain can be retried after
+// the CA rate limited it.
+type retryAfter struct {
+	Until time.Time `datastore:",noindex"`
+}
+
+// rateLimitedUntil returns until when a domain is rate limited, or the zero
+// time if it is not.
+func rateLimitedUntil(ctx context.Context, domain string) (time.Time, error) {
+	k := datastore.NewKey(ctx, retryAfterKind, domain, 0, nil)
+	var e retryAfter
+	switch err := datastore.Get(ctx, k, &e); err {
+	case nil:
+		if time.Now().Before(e.Until) {
+			return e.Until, nil
+		}
+		return time.Time{}, nil
+	case datastore.ErrNoSuchEntity:
+		return time.Time{}, nil
+	default:
+		return time.Time{}, fmt.Errorf("datastore get: %v", err)
+	}
+}
+
+// saveRetryAfter records until when a domain is rate limited if its error
+// tells, see retryAfterRE.
+func saveRetryAfter(ctx context.Context, domain string, err error) error {
+	m := retryAfterRE.FindStringSubmatch(err.Error())
+	if m == nil {
+		return nil
+	}
+	var until time.Time
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05 UTC"} {
+		if t, err := time.Parse(layout, m[1]); err == nil {
+			until = t
+			break
+		}
+	}
+	if until.IsZero() {
+		return nil
+	}
+	k := datastore.NewKey(ctx, retryAfterKind, domain, 0, nil)
+	if _, err := datastore.Put(ctx, k, &retryAfter{Until: until}); err != nil {
+		return fmt.Errorf("datastore put: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// reuseKey is whether certificate keys are kept across renewals rather than
+// generated for each certificate, so that public key pins remain valid, set
+// with the AELE_REUSE_KEY=1 environment variable.
+var reuseKey = os.Getenv("AELE_REUSE_KEY") == "1"
+
+// certKeyKind is the Datastore kind of reused certificate keys.
+const certKeyKind = "AELetsEncryptCertKey"
+
+// storedKey is the Datastore entity of a reused certificate key, keyed by
+// the first domain of the certificate.
+type storedKey struct {
+	Type string `datastore:",noindex"` // key type of newKey
+	Key  []byte `datastore:",noindex"` // PKCS#8 DER encoded
+}
+
+// certificateKey returns the key of a certificate whose first domain is
+// domain, of its configured key type: a new key, or with reuseKey the key
+// stored for the domain, generating and storing one if there is none or it
+// is of another key type.
+func certificateKey(ctx context.Context, domain string) (crypto.Signer, error) {
+	keyType := keyTypeFor(domain)
+	if !reuseKey {
+		return newKey(keyType)
+	}
+	k := datastore.NewKey(ctx, certKeyKind, domain, 0, nil)
+	var s storedKey
+	switch err := datastore.Get(ctx, k, &s); err {
+	case nil:
+		if s.Type != keyType {
+			break
+		}
+		key, err := x509.ParsePKCS8PrivateKey(s.Key)
+		if err != nil {
+			return nil, fmt.Errorf("parse stored key: %v", err)
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("parse stored key: unsupported key %T", key)
+		}
+		return signer, nil
+	case datastore.ErrNoSuchEntity:
+	default:
+		return nil, fmt.Errorf("datastore get: %v", err)
+	}
+
+	key, err := newKey(keyType)
+	if err != nil {
+		return nil, err
+	}
+	b, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := datastore.Put(ctx, k, &storedKey{Type: keyType, Key: b}); err != nil {
+		return nil, fmt.Errorf("datastore put: %v", err)
+	}
+	return key, nil
+}
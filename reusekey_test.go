@@ -0,0 +1,44 @@
+package aeletsencrypt
+
+import (
+	"crypto"
+	"testing"
+)
+
+func TestCertificateKey(t *testing.T) {
+	for _, tt := range []struct {
+		reuseKey bool
+		same     bool
+	}{
+		{false, false},
+		{true, true},
+	} {
+		ctx, _ := newTestContext(t)
+		restore := reuseKey
+		reuseKey = tt.reuseKey
+		first, err := certificateKey(ctx, "example.com")
+		if err != nil {
+			t.Fatalf("certificateKey(reuseKey=%v): %v", tt.reuseKey, err)
+		}
+		second, err := certificateKey(ctx, "example.com")
+		if err != nil {
+			t.Fatalf("certificateKey(reuseKey=%v): %v", tt.reuseKey, err)
+		}
+		other, err := certificateKey(ctx, "example.net")
+		if err != nil {
+			t.Fatalf("certificateKey(reuseKey=%v): %v", tt.reuseKey, err)
+		}
+		reuseKey = restore
+		if same := equalKeys(first, second); same != tt.same {
+			t.Errorf("certificateKey(reuseKey=%v): same key for a domain is %v, want %v", tt.reuseKey, same, tt.same)
+		}
+		if equalKeys(first, other) {
+			t.Errorf("certificateKey(reuseKey=%v): same key for another domain", tt.reuseKey)
+		}
+	}
+}
+
+// equalKeys returns whether two keys have the same public key.
+func equalKeys(a, b crypto.Signer) bool {
+	return a.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(b.Public())
+}
@@ -0,0 +1,39 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"os"
+
+	"google.golang.org/appengine/log"
+)
+
+// sctStrict is whether certificates without embedded Signed Certificate
+// Timestamps are refused rather than only logged, set with the
+// AELE_SCT_STRICT=1 environment variable, for compliance regimes requiring
+// certificates to be logged to Certificate Transparency.
+var sctStrict = os.Getenv("AELE_SCT_STRICT") == "1"
+
+// sctExtension is the embedded SCT list extension (RFC 6962 section 3.3).
+var sctExtension = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+// checkSCT checks a DER encoded leaf certificate embeds SCTs, logging a
+// warning if not, or returning an error in strict mode.
+func checkSCT(ctx context.Context, der []byte) error {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return fmt.Errorf("parse cert: %v", err)
+	}
+	for _, e := range cert.Extensions {
+		if e.Id.Equal(sctExtension) {
+			return nil
+		}
+	}
+	if sctStrict {
+		return fmt.Errorf("certificate for %v has no embedded SCTs", cert.DNSNames)
+	}
+	log.Warningf(ctx, "certificate for %v has no embedded SCTs", cert.DNSNames)
+	return nil
+}
@@ -0,0 +1,110 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/user"
+)
+
+// statusKind is the Datastore kind of the last run status entity.
+const statusKind = "AELetsEncryptStatus"
+
+// runStatus is the Datastore entity of the outcome of the last run,
+// reported as JSON by the status handler for monitoring.
+type runStatus struct {
+	Time       time.Time `json:"time"`
+	Success    bool      `json:"success"`
+	Error      string    `json:"error,omitempty" datastore:",noindex"`
+	Created    int       `json:"created"`
+	Renewed    int       `json:"renewed"`
+	Skipped    int       `json:"skipped"`
+	Failed     int       `json:"failed"`
+	NextExpiry time.Time `json:"next_expiry,omitempty"` // soonest expiry of managed certificates
+	State      string    `json:"state"`                 // ok, failed or critical (see escalate)
+	Critical   []string  `json:"critical,omitempty" datastore:",noindex"`
+	// Leaf expiry of the certificate of each domain, for metrics.
+	ExpiryDomains []string    `json:"-" datastore:",noindex"`
+	ExpiryTimes   []time.Time `json:"-" datastore:",noindex"`
+	// Chain of the certificate of each domain, see chainNames.
+	Chains []domainChain `json:"chains,omitempty" datastore:",noindex"`
+}
+
+// domainChain is the chain of the certificate of a domain.
+type domainChain struct {
+	Domain string `json:"domain"`
+	Chain  string `json:"chain"`
+}
+
+// minRunInterval is the minimum time between runs, so that runs triggered
+// in quick succession, e.g. by visiting the cron handler, do not exhaust CA
+// rate limits. It defaults to 1 hour and is configurable in minutes with the
+// AELE_MIN_RUN_INTERVAL_MINUTES environment variable, from 0 (disabled)
+// to 1440. Runs with ignore_interval=1 and dry-runs are not limited, but runs
+// with force=1 are, since they update all certificates.
+var minRunInterval = time.Duration(envInt("AELE_MIN_RUN_INTERVAL_MINUTES", 60, 0, 24*60)) * time.Minute
+
+// checkRunInterval returns an error if the last run was less than
+// minRunInterval ago.
+func checkRunInterval(ctx context.Context) error {
+	if minRunInterval == 0 {
+		return nil
+	}
+	s, err := loadStatus(ctx)
+	if err != nil || s == nil {
+		return err
+	}
+	if next := s.Time.Add(minRunInterval); time.Now().Before(next) {
+		return &kindError{ErrRateLimited, fmt.Errorf("last run was at %v, next run allowed at %v (in %v), or use ignore_interval=1",
+			s.Time.UTC().Format(time.RFC3339), next.UTC().Format(time.RFC3339), time.Until(next).Round(time.Second))}
+	}
+	return nil
+}
+
+// statusHandler reports the status of the last run as JSON.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	if !user.IsAdmin(ctx) {
+		http.Error(w, "unauthorized", http.StatusForbidden)
+		return
+	}
+	s, err := loadStatus(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if s == nil {
+		http.Error(w, "no run yet", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// loadStatus returns the status of the last run, or nil if there was none.
+func loadStatus(ctx context.Context) (*runStatus, error) {
+	k := datastore.NewKey(ctx, statusKind, "default", 0, nil)
+	var s runStatus
+	switch err := datastore.Get(ctx, k, &s); err {
+	case nil:
+		return &s, nil
+	case datastore.ErrNoSuchEntity:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("datastore get: %v", err)
+	}
+}
+
+// saveStatus saves the status of this run.
+func saveStatus(ctx context.Context, s *runStatus) error {
+	k := datastore.NewKey(ctx, statusKind, "default", 0, nil)
+	if _, err := datastore.Put(ctx, k, s); err != nil {
+		return fmt.Errorf("datastore put: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/acme"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+// tlsALPN is whether the tls-alpn-01 challenge is used as a fallback when
+// http-01 is not offered, set with the AELE_TLS_ALPN=1 environment variable.
+// The challenge certificate must be served during the TLS handshake, so it
+// only works for apps terminating TLS themselves with GetCertificate, which
+// excludes AppEngine standard where Google front ends terminate TLS.
+var tlsALPN = os.Getenv("AELE_TLS_ALPN") == "1"
+
+// tlsALPNKey returns the challenge store key of the tls-alpn-01 challenge
+// certificate for a domain.
+func tlsALPNKey(domain string) string {
+	return "tls-alpn-01:" + domain
+}
+
+// putTLSALPNCert creates the tls-alpn-01 challenge certificate for a domain
+// and stores it for GetCertificate.
+func putTLSALPNCert(ctx context.Context, client *acme.Client, token, domain string) error {
+	if appengine.IsStandard() {
+		return fmt.Errorf("tls-alpn-01 is not possible on AppEngine standard which terminates TLS")
+	}
+	cert, err := client.TLSALPN01ChallengeCert(token, domain)
+	if err != nil {
+		return fmt.Errorf("challenge cert: %v", err)
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("challenge key: %v", err)
+	}
+	var b []byte
+	for _, der := range cert.Certificate {
+		b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	b = append(b, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})...)
+	return putChallenge(ctx, tlsALPNKey(domain), string(b))
+}
+
+// GetCertificate serves tls-alpn-01 challenge certificates, for apps
+// terminating TLS themselves to use as tls.Config GetCertificate when
+// AELE_TLS_ALPN=1, also adding acme.ALPNProto to tls.Config NextProtos.
+// It returns nil for other handshakes so that tls.Config Certificates are
+// used instead.
+func GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	acmeTLS := false
+	for _, proto := range hello.SupportedProtos {
+		if proto == acme.ALPNProto {
+			acmeTLS = true
+		}
+	}
+	if !acmeTLS {
+		return nil, nil
+	}
+	if appengine.IsStandard() {
+		return nil, fmt.Errorf("tls-alpn-01 is not possible on AppEngine standard which terminates TLS")
+	}
+	// There is no request during the handshake, but outside AppEngine
+	// standard the background context reaches Datastore.
+	b, err := getChallenge(appengine.BackgroundContext(), tlsALPNKey(hello.ServerName))
+	if err != nil {
+		if err == memcache.ErrCacheMiss {
+			return nil, fmt.Errorf("no tls-alpn-01 challenge for %v", hello.ServerName)
+		}
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair([]byte(b), []byte(b))
+	if err != nil {
+		return nil, fmt.Errorf("challenge cert: %v", err)
+	}
+	return &cert, nil
+}
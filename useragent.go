@@ -0,0 +1,48 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime/debug"
+
+	"google.golang.org/appengine"
+)
+
+// modulePath is the path of the module of this package.
+const modulePath = "github.com/StalkR/aeletsencrypt"
+
+// customUserAgent replaces the User-Agent of requests to CAs and the Admin
+// API, read from the AELE_USER_AGENT environment variable.
+var customUserAgent = os.Getenv("AELE_USER_AGENT")
+
+// userAgent returns the User-Agent of requests to CAs and the Admin API, so
+// that they can identify the app and contact its operators about problematic
+// usage: customUserAgent, or aeletsencrypt/<version> (+<app ID>).
+func userAgent(ctx context.Context) string {
+	if customUserAgent != "" {
+		return customUserAgent
+	}
+	return fmt.Sprintf("aeletsencrypt/%v (+%v)", moduleVersion(), appengine.AppID(ctx))
+}
+
+// moduleVersion returns the version of the module of this package the app
+// was built with, or devel if unknown, e.g. when built from a checkout.
+func moduleVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "devel"
+	}
+	if info.Main.Path == modulePath && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	for _, m := range info.Deps {
+		if m.Path == modulePath {
+			if m.Replace != nil && m.Replace.Version != "" {
+				return m.Replace.Version
+			}
+			return m.Version
+		}
+	}
+	return "devel"
+}
@@ -0,0 +1,131 @@
+package aeletsencrypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+// webhookURL is the URL to post a JSON summary of each run to, read from
+// the AELE_WEBHOOK_URL environment variable.
+var webhookURL = os.Getenv("AELE_WEBHOOK_URL")
+
+// webhookSecret is the secret shared with the webhook receiver to sign
+// payloads, read from the AELE_WEBHOOK_SECRET environment variable.
+var webhookSecret = os.Getenv("AELE_WEBHOOK_SECRET")
+
+// webhookRetries is how many times posting to the webhook is retried on
+// network or server errors, with exponential backoff, read from the
+// AELE_WEBHOOK_RETRIES environment variable, from 0 to 5, default 2.
+var webhookRetries = envInt("AELE_WEBHOOK_RETRIES", 2, 0, 5)
+
+// webhookPayload is the JSON summary of a run posted to webhookURL.
+// Text is a human readable summary, shown by Slack incoming webhooks.
+type webhookPayload struct {
+	Text      string    `json:"text"`
+	AppID     string    `json:"app_id"`
+	Timestamp time.Time `json:"timestamp"`
+	Domains   []result  `json:"domains"`
+	Critical  []string  `json:"critical,omitempty"` // see escalate
+	Error     string    `json:"error,omitempty"`
+}
+
+// postWebhook posts a summary of a run to webhookURL, if set.
+// Failing to post is logged but does not fail the run.
+func postWebhook(ctx context.Context, results []result, critical []string, err error) {
+	if webhookURL == "" {
+		return
+	}
+	p := webhookPayload{
+		AppID:     appengine.AppID(ctx),
+		Timestamp: time.Now().UTC(),
+		Domains:   []result{},
+		Critical:  critical,
+	}
+	for _, r := range results {
+		if r.Status != "skipped" {
+			p.Domains = append(p.Domains, r)
+		}
+	}
+	text := []string{fmt.Sprintf("aeletsencrypt: %v: %v domains processed", p.AppID, len(p.Domains))}
+	for _, r := range p.Domains {
+		text = append(text, fmt.Sprintf("%v: %v %v", r.Domain, r.Status, r.Error))
+	}
+	for _, c := range critical {
+		text = append(text, "URGENT: "+c)
+	}
+	if err != nil {
+		p.Error = err.Error()
+		text = append(text, "Error: "+p.Error)
+	}
+	p.Text = strings.Join(text, "\n")
+
+	b, err := json.Marshal(p)
+	if err != nil {
+		log.Errorf(ctx, "webhook: %v", err)
+		return
+	}
+	for n := 1; ; n++ {
+		retry, err := sendWebhook(ctx, b)
+		if err == nil {
+			return
+		}
+		if !retry || n > webhookRetries {
+			log.Errorf(ctx, "webhook: %v", err)
+			return
+		}
+		log.Warningf(ctx, "webhook: %v, retrying", err)
+		if sleep(ctx, backoff(n)) != nil {
+			log.Errorf(ctx, "webhook: %v", err)
+			return
+		}
+	}
+}
+
+// sendWebhook posts a payload to webhookURL, signed if webhookSecret is set,
+// returning whether a failure is worth retrying: network and server errors.
+func sendWebhook(ctx context.Context, b []byte) (retry bool, err error) {
+	req, err := http.NewRequest("POST", webhookURL, bytes.NewReader(b))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if webhookSecret != "" {
+		req.Header.Set(signatureHeader, signWebhook(time.Now(), b))
+	}
+	res, err := httpClient(ctx).Do(req.WithContext(ctx))
+	if err != nil {
+		return true, err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return res.StatusCode/100 == 5, fmt.Errorf("%v", res.Status)
+	}
+	return false, nil
+}
+
+// signatureHeader is the header with the signature of webhook payloads.
+const signatureHeader = "X-Aeletsencrypt-Signature"
+
+// signWebhook returns the signature of a webhook payload sent at t:
+// t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<payload>" with
+// webhookSecret>. Receivers recompute it to verify the payload comes from
+// this app, and reject old timestamps to prevent replays.
+func signWebhook(t time.Time, b []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(webhookSecret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(b)
+	return fmt.Sprintf("t=%v,v1=%x", ts, mac.Sum(nil))
+}
@@ -0,0 +1,157 @@
+package aeletsencrypt
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/publicsuffix"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// weeklyLimit is the number of certificates ordered per registered domain
+// (e.g. example.com for www.example.com) in a rolling week, to stay within
+// Let's Encrypt rate limits. It defaults to 50 and is configurable with the
+// AELE_WEEKLY_LIMIT environment variable, from 1 to 1000.
+var weeklyLimit = envInt("AELE_WEEKLY_LIMIT", 50, 1, 1000)
+
+const week = 7 * 24 * time.Hour
+
+// issuedKind is the Datastore kind of the certificates ordered for a
+// registered domain, keyed by registered domain.
+const issuedKind = "AELetsEncryptIssued"
+
+// issued is the Datastore entity of when certificates were ordered for a
+// registered domain in the last week.
+type issued struct {
+	Times []time.Time `datastore:",noindex"`
+}
+
+// limitError is the error of a certificate not ordered because its
+// registered domain reached weeklyLimit.
+type limitError struct {
+	registered string
+	until      time.Time
+}
+
+func (e *limitError) Error() string {
+	return fmt.Sprintf("weekly limit of %v certificates for %v reached, skipping until %v (in %v)",
+		weeklyLimit, e.registered, e.until.UTC().Format(time.RFC3339), time.Until(e.until).Round(time.Minute))
+}
+
+// registeredDomains returns the registered domains of domains.
+func registeredDomains(domains []string) []string {
+	var list []string
+	seen := map[string]bool{}
+	for _, domain := range domains {
+		registered, err := publicsuffix.EffectiveTLDPlusOne(strings.TrimPrefix(domain, "*."))
+		if err != nil {
+			registered = domain
+		}
+		if !seen[registered] {
+			seen[registered] = true
+			list = append(list, registered)
+		}
+	}
+	return list
+}
+
+// reserveIssuance counts a certificate for the domains towards weeklyLimit
+// when ordering from Let's Encrypt, returning a limitError if it is reached,
+// and towards weeklyBudget if set, returning a budgetError if it is spent.
+// It is done in a transaction so that concurrent orders are counted.
+func reserveIssuance(ctx context.Context, domains []string) error {
+	now := time.Now()
+	registered, keys := issuedKeys(ctx, domains)
+	if len(keys) == 0 {
+		return nil
+	}
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		entities := make([]issued, len(keys))
+		if err := getIssued(ctx, keys, entities); err != nil {
+			return err
+		}
+		for i := range entities {
+			var times []time.Time
+			for _, t := range entities[i].Times {
+				if now.Sub(t) < week {
+					times = append(times, t)
+				}
+			}
+			if registered[i] == budgetName {
+				if len(times) >= weeklyBudget {
+					return &budgetError{until: times[len(times)-weeklyBudget].Add(week)}
+				}
+			} else if len(times) >= weeklyLimit {
+				return &limitError{registered: registered[i], until: times[len(times)-weeklyLimit].Add(week)}
+			}
+			entities[i].Times = append(times, now)
+		}
+		if _, err := datastore.PutMulti(ctx, keys, entities); err != nil {
+			return fmt.Errorf("datastore put: %v", err)
+		}
+		return nil
+	}, &datastore.TransactionOptions{XG: len(keys) > 1})
+}
+
+// releaseIssuance uncounts the last certificate for the domains, when it
+// could not be ordered.
+func releaseIssuance(ctx context.Context, domains []string) error {
+	_, keys := issuedKeys(ctx, domains)
+	if len(keys) == 0 {
+		return nil
+	}
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		entities := make([]issued, len(keys))
+		if err := getIssued(ctx, keys, entities); err != nil {
+			return err
+		}
+		for i := range entities {
+			if n := len(entities[i].Times); n > 0 {
+				entities[i].Times = entities[i].Times[:n-1]
+			}
+		}
+		if _, err := datastore.PutMulti(ctx, keys, entities); err != nil {
+			return fmt.Errorf("datastore put: %v", err)
+		}
+		return nil
+	}, &datastore.TransactionOptions{XG: len(keys) > 1})
+}
+
+// issuedKeys returns the names and keys of the issued entities counting a
+// certificate for the domains: their registered domains when ordering from
+// Let's Encrypt, and budgetName with weeklyBudget.
+func issuedKeys(ctx context.Context, domains []string) ([]string, []*datastore.Key) {
+	var names []string
+	if directoryURL() == acme.LetsEncryptURL {
+		names = registeredDomains(domains)
+	}
+	if weeklyBudget > 0 {
+		names = append(names, budgetName)
+	}
+	var keys []*datastore.Key
+	for _, name := range names {
+		keys = append(keys, datastore.NewKey(ctx, issuedKind, name, 0, nil))
+	}
+	return names, keys
+}
+
+// getIssued gets issued entities, leaving missing ones empty.
+func getIssued(ctx context.Context, keys []*datastore.Key, entities []issued) error {
+	err := datastore.GetMulti(ctx, keys, entities)
+	if me, ok := err.(appengine.MultiError); ok {
+		for _, err := range me {
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return fmt.Errorf("datastore get: %v", err)
+			}
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("datastore get: %v", err)
+	}
+	return nil
+}